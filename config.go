@@ -0,0 +1,257 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the content of the YAML file given with --config. Every field
+// maps to the flag of the same name, fields left out keep the flag value and
+// flags set on the command line take precedence over the file. The flags
+// locating the clusters and the configuration itself, --kubeconfig, --master,
+// --context, --insecure-skip-tls-verify, --certificate-authority, --config,
+// --config-map and --validate, are only taken from the command line.
+type Config struct {
+	KubeAPIQPS                *float64         `json:"kubeAPIQPS,omitempty"`
+	KubeAPIBurst              *int             `json:"kubeAPIBurst,omitempty"`
+	Namespace                 string           `json:"namespace,omitempty"`
+	OwnerKinds                []string         `json:"ownerKinds,omitempty"`
+	AllowNonControllerOwners  *bool            `json:"allowNonControllerOwners,omitempty"`
+	PodPhases                 []string         `json:"podPhases,omitempty"`
+	IgnorePodPhase            *bool            `json:"ignorePodPhase,omitempty"`
+	SidecarNames              []string         `json:"sidecarNames,omitempty"`
+	SidecarMatchMode          string           `json:"sidecarMatchMode,omitempty"`
+	SidecarMatchBy            string           `json:"sidecarMatchBy,omitempty"`
+	AutoDetectIstio           *bool            `json:"autoDetectIstio,omitempty"`
+	PrimaryContainer          string           `json:"primaryContainer,omitempty"`
+	IgnoreContainers          []string         `json:"ignoreContainers,omitempty"`
+	ProtectedContainers       []string         `json:"protectedContainers,omitempty"`
+	SuccessExitCodes          []int32          `json:"successExitCodes,omitempty"`
+	CompletedReasons          []string         `json:"completedReasons,omitempty"`
+	RunningDetection          string           `json:"runningDetection,omitempty"`
+	AccountingMode            string           `json:"accountingMode,omitempty"`
+	WatchJobs                 *bool            `json:"watchJobs,omitempty"`
+	RequireOptIn              *bool            `json:"requireOptIn,omitempty"`
+	ShutdownCommand           string           `json:"shutdownCommand,omitempty"`
+	ShutdownStrategy          string           `json:"shutdownStrategy,omitempty"`
+	QuitPort                  *int             `json:"quitPort,omitempty"`
+	DiscoverPIDByName         string           `json:"discoverPIDByName,omitempty"`
+	ExecShell                 string           `json:"execShell,omitempty"`
+	AllowEphemeralFallback    *bool            `json:"allowEphemeralFallback,omitempty"`
+	EphemeralImage            string           `json:"ephemeralImage,omitempty"`
+	ShutdownScriptFile        string           `json:"shutdownScriptFile,omitempty"`
+	KillTarget                string           `json:"killTarget,omitempty"`
+	TerminateOnMainFailure    *bool            `json:"terminateOnMainFailure,omitempty"`
+	ShutdownDelay             *metav1.Duration `json:"shutdownDelay,omitempty"`
+	ShutdownOrder             []string         `json:"shutdownOrder,omitempty"`
+	DrainTimeout              *metav1.Duration `json:"drainTimeout,omitempty"`
+	PreShutdownWebhook        string           `json:"preShutdownWebhook,omitempty"`
+	PreShutdownWebhookTimeout *metav1.Duration `json:"preShutdownWebhookTimeout,omitempty"`
+	EscalationGrace           *metav1.Duration `json:"escalationGrace,omitempty"`
+	VerifyTermination         *bool            `json:"verifyTermination,omitempty"`
+	VerifyTerminationChecks   *int             `json:"verifyTerminationChecks,omitempty"`
+	VerifyCommand             string           `json:"verifyCommand,omitempty"`
+	Workers                   *int             `json:"workers,omitempty"`
+	ExecTimeout               *metav1.Duration `json:"execTimeout,omitempty"`
+	SyncTimeout               *metav1.Duration `json:"syncTimeout,omitempty"`
+	MaxConcurrentExecs        *int             `json:"maxConcurrentExecs,omitempty"`
+	RecheckInterval           *metav1.Duration `json:"recheckInterval,omitempty"`
+	MaxRechecks               *int             `json:"maxRechecks,omitempty"`
+	MaxRetries                *int             `json:"maxRetries,omitempty"`
+	MaxWaitAfterCompletion    *metav1.Duration `json:"maxWaitAfterCompletion,omitempty"`
+	DeletePodOnGiveUp         *bool            `json:"deletePodOnGiveUp,omitempty"`
+	DeleteGracePeriod         *metav1.Duration `json:"deleteGracePeriod,omitempty"`
+	RequeueBaseDelay          *metav1.Duration `json:"requeueBaseDelay,omitempty"`
+	RequeueMaxDelay           *metav1.Duration `json:"requeueMaxDelay,omitempty"`
+	RequeueJitter             *float64         `json:"requeueJitter,omitempty"`
+	ReportOnly                *bool            `json:"reportOnly,omitempty"`
+	DisableEvents             *bool            `json:"disableEvents,omitempty"`
+	EventComponent            string           `json:"eventComponent,omitempty"`
+	EventInstance             string           `json:"eventInstance,omitempty"`
+	DryRun                    *bool            `json:"dryRun,omitempty"`
+	WatchNamespaces           []string         `json:"watchNamespaces,omitempty"`
+	PodSelector               string           `json:"podSelector,omitempty"`
+	ExcludeNamespaces         []string         `json:"excludeNamespaces,omitempty"`
+	MetricsAddr               *string          `json:"metricsAddr,omitempty"`
+	EnablePprof               *bool            `json:"enablePprof,omitempty"`
+	HealthAddr                *string          `json:"healthAddr,omitempty"`
+	EnableLeaderElection      *bool            `json:"enableLeaderElection,omitempty"`
+	LeaderElectionNamespace   string           `json:"leaderElectionNamespace,omitempty"`
+	LeaderElectionID          string           `json:"leaderElectionID,omitempty"`
+}
+
+// Validate checks the values of the file, those it shares with the flags are
+// checked again with the Options
+func (c *Config) Validate() error {
+	if c.SidecarMatchMode != "" {
+		if _, err := newSidecarMatcher(c.SidecarMatchMode, c.SidecarNames); err != nil {
+			return err
+		}
+	}
+	for name, d := range map[string]*metav1.Duration{
+		"shutdownDelay":          c.ShutdownDelay,
+		"escalationGrace":        c.EscalationGrace,
+		"drainTimeout":           c.DrainTimeout,
+		"syncTimeout":            c.SyncTimeout,
+		"recheckInterval":        c.RecheckInterval,
+		"maxWaitAfterCompletion": c.MaxWaitAfterCompletion,
+		"deleteGracePeriod":      c.DeleteGracePeriod,
+	} {
+		if d != nil && d.Duration < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	if c.ExecTimeout != nil && c.ExecTimeout.Duration <= 0 {
+		return fmt.Errorf("execTimeout must be positive")
+	}
+	if c.Workers != nil && *c.Workers <= 0 {
+		return fmt.Errorf("workers must be positive")
+	}
+	if c.MaxRetries != nil && *c.MaxRetries < 0 {
+		return fmt.Errorf("maxRetries must not be negative")
+	}
+	if c.MaxConcurrentExecs != nil && *c.MaxConcurrentExecs <= 0 {
+		return fmt.Errorf("maxConcurrentExecs must be positive")
+	}
+	return nil
+}
+
+// loadConfigFile reads the Config from path and applies it to the flags that
+// were not set on the command line
+func loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+	var config Config
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	config.apply(set)
+	return nil
+}
+
+// apply copies the values of the file to the flag variables, skipping the
+// flags in set
+func (c *Config) apply(set map[string]bool) {
+	applyString := func(name string, value string, to *string) {
+		if value != "" && !set[name] {
+			*to = value
+		}
+	}
+	applyList := func(name string, value []string, to *string) {
+		if value != nil && !set[name] {
+			*to = strings.Join(value, ",")
+		}
+	}
+	applyBool := func(name string, value *bool, to *bool) {
+		if value != nil && !set[name] {
+			*to = *value
+		}
+	}
+	applyInt := func(name string, value *int, to *int) {
+		if value != nil && !set[name] {
+			*to = *value
+		}
+	}
+	applyFloat := func(name string, value *float64, to *float64) {
+		if value != nil && !set[name] {
+			*to = *value
+		}
+	}
+	applyDuration := func(name string, value *metav1.Duration, to *time.Duration) {
+		if value != nil && !set[name] {
+			*to = value.Duration
+		}
+	}
+
+	applyFloat("kube-api-qps", c.KubeAPIQPS, &kubeAPIQPS)
+	applyInt("kube-api-burst", c.KubeAPIBurst, &kubeAPIBurst)
+	applyString("namespace", c.Namespace, &namespace)
+	applyList("owner-kinds", c.OwnerKinds, &ownerKinds)
+	applyBool("allow-non-controller-owners", c.AllowNonControllerOwners, &anyOwner)
+	applyList("pod-phases", c.PodPhases, &podPhases)
+	applyBool("ignore-pod-phase", c.IgnorePodPhase, &ignorePodPhase)
+	applyList("sidecar-names", c.SidecarNames, &sidecarNames)
+	applyString("sidecar-match-mode", c.SidecarMatchMode, &sidecarMatchMode)
+	applyString("sidecar-match-by", c.SidecarMatchBy, &sidecarMatchBy)
+	applyBool("auto-detect-istio", c.AutoDetectIstio, &autoDetectIstio)
+	applyString("primary-container", c.PrimaryContainer, &primaryContainer)
+	applyList("ignore-containers", c.IgnoreContainers, &ignoreContainers)
+	applyList("protected-containers", c.ProtectedContainers, &protectedContainers)
+	if c.SuccessExitCodes != nil && !set["success-exit-codes"] {
+		codes := make([]string, 0, len(c.SuccessExitCodes))
+		for _, code := range c.SuccessExitCodes {
+			codes = append(codes, strconv.Itoa(int(code)))
+		}
+		successExitCodes = strings.Join(codes, ",")
+	}
+	applyList("completed-reasons", c.CompletedReasons, &completedReasons)
+	applyString("running-detection", c.RunningDetection, &runningDetection)
+	applyString("accounting-mode", c.AccountingMode, &accountingMode)
+	applyBool("watch-jobs", c.WatchJobs, &watchJobs)
+	applyBool("require-opt-in", c.RequireOptIn, &requireOptIn)
+	applyString("shutdown-command", c.ShutdownCommand, &shutdownCommand)
+	applyString("shutdown-strategy", c.ShutdownStrategy, &shutdownStrategy)
+	applyInt("quit-port", c.QuitPort, &quitPort)
+	applyString("discover-pid-by-name", c.DiscoverPIDByName, &discoverPID)
+	applyString("exec-shell", c.ExecShell, &execShell)
+	applyBool("allow-ephemeral-fallback", c.AllowEphemeralFallback, &ephemeralFallback)
+	applyString("ephemeral-image", c.EphemeralImage, &ephemeralImage)
+	applyString("shutdown-script-file", c.ShutdownScriptFile, &shutdownScript)
+	applyString("kill-target", c.KillTarget, &killTarget)
+	applyBool("terminate-on-main-failure", c.TerminateOnMainFailure, &terminateOnMainFailure)
+	applyDuration("shutdown-delay", c.ShutdownDelay, &shutdownDelay)
+	applyList("shutdown-order", c.ShutdownOrder, &shutdownOrder)
+	applyDuration("drain-timeout", c.DrainTimeout, &drainTimeout)
+	applyString("pre-shutdown-webhook", c.PreShutdownWebhook, &webhookURL)
+	applyDuration("pre-shutdown-webhook-timeout", c.PreShutdownWebhookTimeout, &webhookTimeout)
+	applyDuration("escalation-grace", c.EscalationGrace, &escalationGrace)
+	applyBool("verify-termination", c.VerifyTermination, &verifyTermination)
+	applyInt("verify-termination-checks", c.VerifyTerminationChecks, &verifyChecks)
+	applyString("verify-command", c.VerifyCommand, &verifyCommand)
+	applyInt("workers", c.Workers, &workers)
+	applyDuration("exec-timeout", c.ExecTimeout, &execTimeout)
+	applyDuration("sync-timeout", c.SyncTimeout, &syncTimeout)
+	applyInt("max-concurrent-execs", c.MaxConcurrentExecs, &maxExecs)
+	applyDuration("recheck-interval", c.RecheckInterval, &recheckInterval)
+	applyInt("max-rechecks", c.MaxRechecks, &maxRechecks)
+	applyInt("max-retries", c.MaxRetries, &maxRetries)
+	applyDuration("max-wait-after-completion", c.MaxWaitAfterCompletion, &maxWait)
+	applyBool("delete-pod-on-give-up", c.DeletePodOnGiveUp, &deleteOnGiveUp)
+	applyDuration("delete-grace-period", c.DeleteGracePeriod, &deleteGrace)
+	applyDuration("requeue-base-delay", c.RequeueBaseDelay, &requeueBaseDelay)
+	applyDuration("requeue-max-delay", c.RequeueMaxDelay, &requeueMaxDelay)
+	applyFloat("requeue-jitter", c.RequeueJitter, &requeueJitter)
+	applyBool("report-only", c.ReportOnly, &reportOnly)
+	applyBool("disable-events", c.DisableEvents, &disableEvents)
+	applyString("event-component", c.EventComponent, &eventComponent)
+	applyString("event-instance", c.EventInstance, &eventInstance)
+	applyBool("dry-run", c.DryRun, &dryRun)
+	applyList("watch-namespaces", c.WatchNamespaces, &watchNamespaces)
+	applyString("pod-selector", c.PodSelector, &podSelector)
+	applyList("exclude-namespaces", c.ExcludeNamespaces, &excludeNamespaces)
+	if c.MetricsAddr != nil && !set["metrics-addr"] {
+		metricsAddr = *c.MetricsAddr
+	}
+	applyBool("enable-pprof", c.EnablePprof, &enablePprof)
+	if c.HealthAddr != nil && !set["health-addr"] {
+		healthAddr = *c.HealthAddr
+	}
+	applyBool("enable-leader-election", c.EnableLeaderElection, &enableLeaderElection)
+	applyString("leader-election-namespace", c.LeaderElectionNamespace, &leaderElectionNamespace)
+	applyString("leader-election-id", c.LeaderElectionID, &leaderElectionID)
+}
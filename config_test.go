@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// commandLineOnlyFlags are the flags the config file does not set
+var commandLineOnlyFlags = newStringSet("kubeconfig", "master", "context", "insecure-skip-tls-verify",
+	"certificate-authority", "config", "config-map", "validate")
+
+func TestConfigCoversFlags(t *testing.T) {
+	fs := flag.NewFlagSet("controller", flag.ContinueOnError)
+	registerFlags(fs)
+	keys := newStringSet()
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		key, _, _ := strings.Cut(configType.Field(i).Tag.Get("json"), ",")
+		keys.Add(strings.ToLower(key))
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if commandLineOnlyFlags.Contains(f.Name) {
+			return
+		}
+		if key := strings.ReplaceAll(f.Name, "-", ""); !keys.Contains(key) {
+			t.Errorf("flag --%s has no key in the config file", f.Name)
+		}
+	})
+}
+
+func TestConfigApply(t *testing.T) {
+	// The flag variables keep their defaults for the other tests
+	savedMode, savedCommand, savedTimeout, savedCodes, savedWorkers := accountingMode, verifyCommand, syncTimeout, successExitCodes, workers
+	t.Cleanup(func() {
+		accountingMode, verifyCommand, syncTimeout, successExitCodes, workers = savedMode, savedCommand, savedTimeout, savedCodes, savedWorkers
+	})
+	accountingMode, verifyCommand, syncTimeout, successExitCodes, workers = AccountingStrict, "", 0, "", 2
+
+	var config Config
+	err := yaml.UnmarshalStrict([]byte(`
+accountingMode: lenient
+verifyCommand: pgrep envoy
+syncTimeout: 1m
+successExitCodes: [0, 2]
+workers: 4
+`), &config)
+	if err != nil {
+		t.Fatalf("error parsing config: %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	// Flags given on the command line take precedence
+	config.apply(map[string]bool{"workers": true})
+
+	if accountingMode != AccountingLenient {
+		t.Errorf("accountingMode = %q, want %q", accountingMode, AccountingLenient)
+	}
+	if verifyCommand != "pgrep envoy" {
+		t.Errorf("verifyCommand = %q, want %q", verifyCommand, "pgrep envoy")
+	}
+	if syncTimeout != time.Minute {
+		t.Errorf("syncTimeout = %s, want %s", syncTimeout, time.Minute)
+	}
+	if successExitCodes != "0,2" {
+		t.Errorf("successExitCodes = %q, want %q", successExitCodes, "0,2")
+	}
+	if workers != 2 {
+		t.Errorf("workers = %d, want the command line value 2", workers)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "valid", config: "shutdownDelay: 10s\nworkers: 4"},
+		{name: "negative duration", config: "syncTimeout: -1s", wantErr: "syncTimeout must not be negative"},
+		{name: "no workers", config: "workers: 0", wantErr: "workers must be positive"},
+		{name: "no execs", config: "maxConcurrentExecs: 0", wantErr: "maxConcurrentExecs must be positive"},
+		{name: "invalid regex", config: "sidecarMatchMode: regex\nsidecarNames: ['istio-proxy-(']", wantErr: "invalid sidecar regex"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config Config
+			if err := yaml.UnmarshalStrict([]byte(tt.config), &config); err != nil {
+				t.Fatalf("error parsing config: %v", err)
+			}
+			err := config.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
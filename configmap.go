@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// Keys of the configuration ConfigMap, settings missing from it keep the
+// values given on the command line
+const (
+	configKeySidecarNames    = "sidecar-names"
+	configKeyShutdownCommand = "shutdown-command"
+	configKeyShutdownDelay   = "shutdown-delay"
+)
+
+// configReloadDelay debounces bursts of ConfigMap updates into one reload
+const configReloadDelay = 2 * time.Second
+
+// liveConfig holds the settings of the Controller that can be changed
+// through the configuration ConfigMap while it runs
+type liveConfig struct {
+	// sidecars matches the default sidecar container names
+	sidecars *sidecarMatcher
+	// shutdownCommand is executed in each sidecar to terminate it
+	shutdownCommand string
+	// shutdownDelay is the grace period granted to the pod after its main
+	// containers finished
+	shutdownDelay time.Duration
+}
+
+// config returns the current live configuration
+func (c *Controller) config() liveConfig {
+	c.liveConfigLock.RLock()
+	defer c.liveConfigLock.RUnlock()
+	return c.liveConfig
+}
+
+// WatchConfigMap reloads the live configuration from the named ConfigMap
+// whenever it changes. The informer must be started by the caller.
+func (c *Controller) WatchConfigMap(ctx context.Context, configMapInformer coreinformers.ConfigMapInformer, namespace, name string) {
+	logger := klog.FromContext(ctx)
+	lister := configMapInformer.Lister()
+
+	reload := func() {
+		configMap, err := lister.ConfigMaps(namespace).Get(name)
+		if err != nil {
+			logger.Info("Configuration ConfigMap not found, using defaults", "configMap", klog.KRef(namespace, name))
+			c.setConfig(c.defaultConfig)
+			return
+		}
+		config, err := c.parseConfigMap(configMap)
+		if err != nil {
+			logger.Error(err, "Invalid configuration ConfigMap, keeping current configuration", "configMap", klog.KObj(configMap))
+			return
+		}
+		c.setConfig(config)
+		logger.Info("Reloaded configuration", "configMap", klog.KObj(configMap),
+			"sidecars", configMap.Data[configKeySidecarNames], "shutdownCommand", config.shutdownCommand,
+			"shutdownDelay", config.shutdownDelay)
+	}
+
+	// The handlers are called one at a time, so the timer needs no locking
+	schedule := func(obj interface{}) {
+		if c.configReload == nil {
+			c.configReload = time.AfterFunc(configReloadDelay, reload)
+			return
+		}
+		c.configReload.Reset(configReloadDelay)
+	}
+
+	configMapInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			configMap, ok := obj.(*corev1.ConfigMap)
+			return ok && configMap.Namespace == namespace && configMap.Name == name
+		},
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc:    schedule,
+			UpdateFunc: func(old, new interface{}) { schedule(new) },
+			DeleteFunc: schedule,
+		},
+	})
+}
+
+// setConfig replaces the live configuration
+func (c *Controller) setConfig(config liveConfig) {
+	c.liveConfigLock.Lock()
+	defer c.liveConfigLock.Unlock()
+	c.liveConfig = config
+}
+
+// parseConfigMap builds the live configuration from the ConfigMap, starting
+// from the defaults for the missing keys
+func (c *Controller) parseConfigMap(configMap *corev1.ConfigMap) (liveConfig, error) {
+	config := c.defaultConfig
+
+	if value, ok := configMap.Data[configKeySidecarNames]; ok {
+		sidecars, err := newSidecarMatcher(c.sidecarMatchMode, strings.Split(value, ","))
+		if err != nil {
+			return config, err
+		}
+		config.sidecars = sidecars
+	}
+	if value, ok := configMap.Data[configKeyShutdownCommand]; ok {
+		if strings.TrimSpace(value) == "" {
+			return config, fmt.Errorf("%s must not be empty", configKeyShutdownCommand)
+		}
+		config.shutdownCommand = value
+	}
+	if value, ok := configMap.Data[configKeyShutdownDelay]; ok {
+		delay, err := time.ParseDuration(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid %s: %w", configKeyShutdownDelay, err)
+		}
+		if delay < 0 {
+			return config, fmt.Errorf("%s must not be negative", configKeyShutdownDelay)
+		}
+		config.shutdownDelay = delay
+	}
+	return config, nil
+}
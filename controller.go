@@ -18,12 +18,27 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-	"bytes"
 
+	"golang.org/x/time/rate"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	podinformers "k8s.io/client-go/informers/core/v1"
@@ -31,40 +46,587 @@ import (
 	"k8s.io/client-go/kubernetes/scheme"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	podlisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
+	utilexec "k8s.io/client-go/util/exec"
 	"k8s.io/client-go/util/workqueue"
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
-	"k8s.io/client-go/tools/remotecommand"
-	set "github.com/deckarep/golang-set"
 )
 
 const controllerAgentName = "terminate-sidecar-job-controller"
 
+// DefaultShutdownCommand is the command run in a sidecar to shut it down
+const DefaultShutdownCommand = "kill -s TERM 1"
+
+// KillCommand is run in a sidecar that outlived the escalation grace period
+const KillCommand = "kill -s KILL 1"
+
+const (
+	// ShutdownStrategySignal runs the shutdown command in the sidecar
+	ShutdownStrategySignal = "signal"
+	// ShutdownStrategyQuitQuitQuit asks the istio pilot-agent to exit through
+	// its /quitquitquit endpoint, falling back to the shutdown command when
+	// curl is not available in the sidecar
+	ShutdownStrategyQuitQuitQuit = "quitquitquit"
+
+	// DefaultQuitPort is the port pilot-agent serves /quitquitquit on
+	DefaultQuitPort = 15020
+)
+
+const (
+	// ExecShellSh and ExecShellBash run the shutdown command with "-c" in
+	// that shell
+	ExecShellSh   = "sh"
+	ExecShellBash = "bash"
+	// ExecShellNone runs the shutdown command split on spaces as argv
+	// directly, for distroless sidecars without a shell
+	ExecShellNone = "none"
+)
+
+const (
+	// AccountingStrict shuts the sidecars down only once every container
+	// of the pod is either running or completed
+	AccountingStrict = "strict"
+	// AccountingLenient shuts the sidecars down once every main container
+	// completed, whatever the state of the sidecars
+	AccountingLenient = "lenient"
+)
+
+const (
+	// RunningDetectionReady counts Ready containers as running
+	RunningDetectionReady = "ready"
+	// RunningDetectionState counts containers in the Running state as
+	// running whether they are Ready or not, e.g. draining sidecars
+	RunningDetectionState = "state"
+	// RunningDetectionSidecarState counts sidecars in the Running state as
+	// running whether they are Ready or not, and main containers only when
+	// they are Ready
+	RunningDetectionSidecarState = "sidecar-state"
+)
+
+const (
+	// KillTargetPID1 signals PID 1 of the sidecar through the shutdown
+	// command
+	KillTargetPID1 = "pid1"
+	// KillTargetProcessPrefix followed by a process name signals the
+	// processes of that name with pkill instead, for sidecars running
+	// under an init wrapper such as tini
+	KillTargetProcessPrefix = "process:"
+)
+
+const (
+	// annotationPrefix is the prefix shared by every pod annotation the
+	// controller understands
+	annotationPrefix = "terminate-sidecar.nebed.io/"
+	// SidecarsAnnotation lists the sidecar containers of a pod as a comma
+	// separated string, overriding the controller wide default
+	SidecarsAnnotation = annotationPrefix + "sidecars"
+	// EnabledAnnotation marks a pod as opted in when the controller runs
+	// with RequireOptIn
+	EnabledAnnotation = annotationPrefix + "enabled"
+	// DisabledAnnotation set to "true" exempts a pod from the controller,
+	// even when it does not run with RequireOptIn
+	DisabledAnnotation = annotationPrefix + "disabled"
+	// KeepSidecarsAnnotation set to "true" keeps the sidecars of a pod
+	// running, for Jobs whose own lifecycle stops them. It is usually set
+	// in the pod template of the Job.
+	KeepSidecarsAnnotation = annotationPrefix + "keep-sidecars"
+	// ForceAnnotation set to "true" makes the controller handle a pod that
+	// is not owned by a Job or one of the other owner kinds, such as a bare
+	// pod running a CI build
+	ForceAnnotation = annotationPrefix + "force"
+	// SignaledAnnotation records when the sidecars of a pod were sent the
+	// shutdown command so they are not signaled again
+	SignaledAnnotation = annotationPrefix + "signaled"
+	// ResultAnnotation records the outcome of the shutdown of the sidecars
+	// of a pod as JSON, outliving the Events
+	ResultAnnotation = annotationPrefix + "result"
+	// OrderAnnotation lists sidecars as a comma separated string in the
+	// order they must be shut down, overriding the controller wide order
+	OrderAnnotation = annotationPrefix + "order"
+	// DebugAnnotation set to "true" records why the sidecars of a pod are
+	// not shut down as Events on the pod
+	DebugAnnotation = annotationPrefix + "debug"
+	// ShutdownURLAnnotationPrefix followed by a container name sets a URL
+	// the sidecar is shut down by posting to, e.g. linkerd-proxy's
+	// http://localhost:4191/shutdown
+	ShutdownURLAnnotationPrefix = annotationPrefix + "shutdown-url."
+	// PrimaryContainerAnnotation names the container of a pod whose
+	// completion alone triggers the shutdown of the sidecars, overriding
+	// the controller wide primary container
+	PrimaryContainerAnnotation = annotationPrefix + "primary-container"
+	// SignalAnnotationPrefix followed by a container name sets the signal,
+	// e.g. QUIT or HUP, the sidecar is sent in place of the shutdown command
+	SignalAnnotationPrefix = annotationPrefix + "signal."
+
+	// IstioStatusAnnotation is set by the istio sidecar injector, its
+	// JSON value lists the injected containers
+	IstioStatusAnnotation = "sidecar.istio.io/status"
+)
+
 const (
-	// SuccessSynced is used as part of the Event 'reason' when a Foo is synced
-	SuccessSynced = "Synced"
-	// ErrResourceExists is used as part of the Event 'reason' when a Foo fails
-	// to sync due to a Deployment of the same name already existing.
-	ErrResourceExists = "ErrResourceExists"
-
-	// MessageResourceExists is the message used for Events when a resource
-	// fails to sync due to a Deployment already existing
-	MessageResourceExists = "Resource %q already exists and is not managed by Foo"
-	// MessageResourceSynced is the message used for an Event fired when a Foo
-	// is synced successfully
-	MessageResourceSynced = "Pod synced successfully"
+	// signaledCacheSize bounds the number of pods remembered as signaled
+	// until the SignaledAnnotation shows up in the informer cache
+	signaledCacheSize = 4096
+	// signaledCacheTTL is how long a pod is remembered as signaled
+	signaledCacheTTL = time.Hour
+
+	// terminationPollInterval and terminationWaitTimeout control how an
+	// ordered shutdown waits for each container to terminate
+	terminationPollInterval = time.Second
+	terminationWaitTimeout  = 30 * time.Second
+
+	// execForbiddenBackoff is the wait before a pod is retried while the
+	// controller is not allowed to exec into pods
+	execForbiddenBackoff = 5 * time.Minute
+
+	// shutdownVetoedBackoff is the wait before the pre-shutdown webhook is
+	// asked again about a pod whose shutdown it vetoed
+	shutdownVetoedBackoff = 30 * time.Second
+
+	// verifyTerminationInterval is the wait between two checks that the
+	// signaled sidecars of a pod terminated
+	verifyTerminationInterval = 10 * time.Second
+
+	// verifyCommandInterval and verifyCommandTimeout control how often and
+	// how long the verify command is run in a signaled sidecar
+	verifyCommandInterval = time.Second
+	verifyCommandTimeout  = 10 * time.Second
 )
 
+const (
+	// DryRunShutdown is used as part of the Event 'reason' when a shutdown
+	// is skipped because the controller runs in dry-run mode
+	DryRunShutdown = "DryRunShutdown"
+	// MessageDryRunShutdown is the message used for an Event fired when a
+	// shutdown is skipped in dry-run mode
+	MessageDryRunShutdown = "Dry run: would run %q in container %s"
+
+	// SidecarTerminated is used as part of the Event 'reason' when sidecars
+	// have been sent the shutdown command
+	SidecarTerminated = "SidecarTerminated"
+	// MessageSidecarTerminated is the message used for an Event fired when
+	// sidecars have been sent the shutdown command, it lists the result for
+	// every sidecar
+	MessageSidecarTerminated = "Shut down sidecar containers: %s"
+	// SidecarTerminationFailed is used as part of the Event 'reason' when
+	// the shutdown command could not be run in a sidecar
+	SidecarTerminationFailed = "SidecarTerminationFailed"
+	// MessageSidecarTerminationFailed is the message used for an Event fired
+	// when the shutdown of a sidecar fails, it lists the result for every
+	// sidecar including the stderr of the failed commands
+	MessageSidecarTerminationFailed = "Failed to shut down sidecar containers: %s"
+
+	// SidecarShutdownSkipped is used as part of the Event 'reason' when the
+	// sidecars of a pod carrying the DebugAnnotation are not shut down
+	SidecarShutdownSkipped = "SidecarShutdownSkipped"
+
+	// MaxRetriesExceeded is used as part of the Event 'reason' when the
+	// controller stops retrying a pod
+	MaxRetriesExceeded = "MaxRetriesExceeded"
+	// MessageMaxRetriesExceeded is the message used for an Event fired when
+	// the controller stops retrying a pod
+	MessageMaxRetriesExceeded = "Giving up shutting down sidecars after %d retries: %v"
+
+	// ShutdownFailedPermanently is used as part of the Event 'reason' when
+	// the shutdown fails with an error retrying cannot fix, such as missing
+	// RBAC permissions
+	ShutdownFailedPermanently = "ShutdownFailedPermanently"
+	// MessageShutdownFailedPermanently is the message used for an Event
+	// fired when the controller does not retry a failed shutdown
+	MessageShutdownFailedPermanently = "Not retrying the sidecar shutdown: %v"
+
+	// DeletingPod is used as part of the Event 'reason' when the controller
+	// deletes a pod whose sidecars it gave up shutting down
+	DeletingPod = "DeletingPod"
+	// MessageDeletingPod is the message used for an Event fired before a
+	// pod is deleted after the controller gave up on its sidecars
+	MessageDeletingPod = "Deleting pod with a grace period of %ds after failing to shut its sidecars down"
+
+	// ShutdownTimedOut is used as part of the Event 'reason' when the
+	// controller stops trying to shut the sidecars of a pod down because
+	// its main containers finished too long ago
+	ShutdownTimedOut = "ShutdownTimedOut"
+	// MessageShutdownTimedOut is the message used for an Event fired when
+	// the controller stops trying to shut the sidecars down
+	MessageShutdownTimedOut = "Sidecars still not shut down %s after the main containers finished, giving up, manual intervention needed: %v"
+
+	// SidecarNameMismatch is used as part of the Event 'reason' when the
+	// only container of a pod still running is not a sidecar
+	SidecarNameMismatch = "SidecarNameMismatch"
+	// MessageSidecarNameMismatch is the message used for an Event fired
+	// when the only container still running is not a sidecar, which
+	// usually means the sidecar names are misconfigured
+	MessageSidecarNameMismatch = "Container %s is the only one still running but is not one of the sidecars %s, check the sidecar names"
+
+	// ShutdownVetoed is used as part of the Event 'reason' when the
+	// pre-shutdown webhook does not allow the shutdown of the sidecars
+	ShutdownVetoed = "ShutdownVetoed"
+	// MessageShutdownVetoed is the message used for an Event fired when
+	// the pre-shutdown webhook answers anything but 200
+	MessageShutdownVetoed = "Pre-shutdown webhook answered %d, not shutting down sidecars"
+
+	// SidecarStillRunning is used as part of the Event 'reason' when
+	// signaled sidecars keep running, e.g. because they ignore the signal
+	SidecarStillRunning = "SidecarStillRunning"
+	// MessageSidecarStillRunning is the message used for an Event fired
+	// when signaled sidecars are still running after the last check
+	MessageSidecarStillRunning = "Sidecar containers %s still running %d checks after the shutdown command"
+
+	// SidecarProcessExited is used as part of the Event 'reason' when the
+	// verify command confirmed that the processes of sidecars exited
+	SidecarProcessExited = "SidecarProcessExited"
+	// MessageSidecarProcessExited is the message used for an Event fired
+	// when the verify command reports the processes of sidecars gone
+	MessageSidecarProcessExited = "Verified that the processes of sidecar containers %s exited"
+	// SidecarProcessRunning is used as part of the Event 'reason' when the
+	// verify command still finds the processes of signaled sidecars
+	SidecarProcessRunning = "SidecarProcessRunning"
+	// MessageSidecarProcessRunning is the message used for an Event fired
+	// when the processes of sidecars outlive the verify command's timeout
+	MessageSidecarProcessRunning = "Processes of sidecar containers %s still running %s after the shutdown command"
+)
+
+// errContainerNotFound is returned for execs into a container that does not
+// exist, retrying them cannot succeed
+var errContainerNotFound = errors.New("container not found")
+
+// blockedWaitingReasons are the reasons of Waiting containers that are not
+// expected to start without outside intervention
+var blockedWaitingReasons = newStringSet(
+	"ErrImagePull",
+	"ImagePullBackOff",
+	"ErrImageNeverPull",
+	"InvalidImageName",
+	"CreateContainerConfigError",
+	"CreateContainerError",
+)
+
+// shutdownSignals are the signals the SignalAnnotationPrefix annotations may
+// name
+var shutdownSignals = newStringSet(
+	"HUP", "INT", "QUIT", "ABRT", "KILL", "USR1", "USR2", "ALRM", "TERM",
+)
+
+// maxOutputLength bounds the exec output kept for logs and Events
+const maxOutputLength = 1024
+
+// Options holds the settings used to configure the Controller
+type Options struct {
+	// Sidecars is the default list of sidecar container names, used for
+	// pods that do not carry the SidecarsAnnotation
+	Sidecars []string
+	// SidecarMatchMode selects how container names are matched against the
+	// sidecar names, one of SidecarMatchExact, SidecarMatchGlob or
+	// SidecarMatchRegex
+	SidecarMatchMode string
+	// SidecarMatchBy selects what the sidecar patterns are matched against,
+	// SidecarMatchByName or SidecarMatchByImage
+	SidecarMatchBy string
+	// RequireOptIn restricts the controller to pods carrying the
+	// EnabledAnnotation set to "true"
+	RequireOptIn bool
+	// ShutdownCommand is run inside every sidecar to stop it, with "-c" by
+	// the ExecShell or split on spaces with ExecShellNone
+	ShutdownCommand string
+	// ShutdownStrategy selects how sidecars are stopped, one of
+	// ShutdownStrategySignal or ShutdownStrategyQuitQuitQuit
+	ShutdownStrategy string
+	// QuitPort is the port of the /quitquitquit endpoint
+	QuitPort int
+	// DiscoverPIDByName, when set, is a pgrep -f pattern matching the
+	// command lines of the processes signaled in place of PID 1
+	DiscoverPIDByName string
+	// ExecShell is the shell running the shutdown command, one of
+	// ExecShellSh, ExecShellBash or ExecShellNone
+	ExecShell string
+	// ShutdownScript, when set, is streamed to "sh -s" in the sidecars in
+	// place of running the shutdown command
+	ShutdownScript string
+	// KillTarget selects the process that is signaled, KillTargetPID1 or
+	// KillTargetProcessPrefix followed by a process name
+	KillTarget string
+	// DryRun logs the shutdown commands instead of executing them
+	DryRun bool
+	// DisableEvents stops the controller from recording any Event
+	DisableEvents bool
+	// ReportOnly only counts the pods whose sidecars would be shut down,
+	// without signaling or annotating them
+	ReportOnly bool
+	// WatchNamespaces restricts the controller to pods in these namespaces,
+	// all namespaces are handled when it is empty
+	WatchNamespaces []string
+	// ExcludeNamespaces lists namespaces whose pods are never handled, it
+	// takes precedence over WatchNamespaces
+	ExcludeNamespaces []string
+	// ShutdownDelay is how long to wait after the last main container
+	// finished before the sidecars are signaled
+	ShutdownDelay time.Duration
+	// ShutdownOrder lists sidecars in the order they must be shut down,
+	// sidecars not listed are shut down last
+	ShutdownOrder []string
+	// DrainTimeout bounds how long Run waits for in-flight work items when
+	// the controller is stopped
+	DrainTimeout time.Duration
+	// RequeueBaseDelay and RequeueMaxDelay bound the exponential backoff of
+	// failing pods
+	RequeueBaseDelay time.Duration
+	RequeueMaxDelay  time.Duration
+	// RequeueJitter is the largest fraction of its backoff delay added at
+	// random to the retry of a failing pod, the result never exceeding
+	// RequeueMaxDelay. 0 disables the jitter.
+	RequeueJitter float64
+	// DeletePodOnGiveUp deletes the pods whose sidecars could not be shut
+	// down within MaxRetries retries, with DeleteGracePeriod as the grace
+	// period
+	DeletePodOnGiveUp bool
+	DeleteGracePeriod time.Duration
+	// MaxWaitAfterCompletion is how long after the main containers finished
+	// the controller keeps trying to shut the sidecars down, 0 keeps trying
+	MaxWaitAfterCompletion time.Duration
+	// MaxRetries is the number of times a failing pod is requeued before
+	// the controller gives up on it, 0 retries forever
+	MaxRetries int
+	// OwnerKinds lists the Kinds of the controllers whose pods are handled
+	OwnerKinds []string
+	// NonControllerOwners also handles pods without a controller that list
+	// an owner of one of the OwnerKinds. Such an owner may not be the one
+	// managing the pod, so this is off by default.
+	NonControllerOwners bool
+	// ExecTimeout bounds each exec into a sidecar
+	ExecTimeout time.Duration
+	// SyncTimeout bounds the whole sync of a pod, which is requeued with a
+	// backoff when it expires. 0 disables it.
+	SyncTimeout time.Duration
+	// MaxConcurrentExecs caps the execs open at the same time across all
+	// workers
+	MaxConcurrentExecs int
+	// TerminateOnMainFailure shuts the sidecars down even when a main
+	// container failed, otherwise they are left running for debugging
+	TerminateOnMainFailure bool
+	// SuccessExitCodes lists the exit codes of main containers that count as
+	// success whatever their termination reason. When empty, containers
+	// terminated with the "Error" reason count as failed.
+	SuccessExitCodes []int32
+	// CompletedReasons lists the termination reasons of the containers
+	// that are accounted for as completed. When empty every reason is with
+	// SuccessExitCodes, and DefaultCompletedReasons are without. Without
+	// SuccessExitCodes main containers terminated with any other reason
+	// than "Completed" count as failed.
+	CompletedReasons []string
+	// PrimaryContainer names the container of the pods whose completion
+	// alone triggers the shutdown of their sidecars, whatever the state of
+	// the other main containers. Pods without it are handled as usual.
+	PrimaryContainer string
+	// ContainerClassifier decides the state of each container of a pod,
+	// the NewDefaultContainerClassifier with SuccessExitCodes,
+	// CompletedReasons and RunningDetection when nil
+	ContainerClassifier ContainerClassifier
+	// AccountingMode is AccountingStrict or AccountingLenient
+	AccountingMode string
+	// RunningDetection decides which containers the default classifier
+	// counts as running, RunningDetectionReady, RunningDetectionState or
+	// RunningDetectionSidecarState
+	RunningDetection string
+	// IgnoreContainers lists containers, such as debug containers, that
+	// are left out when deciding whether only sidecars are still running
+	IgnoreContainers []string
+	// ProtectedContainers lists containers, such as cleanup helpers, that
+	// may keep running like sidecars without holding up the shutdown of
+	// the others but are never shut down themselves
+	ProtectedContainers []string
+	// Executor runs the shutdown commands in the sidecars, exec'ing through
+	// the API server with the controller's rest config when nil
+	Executor Executor
+	// PodPhases lists the pod phases in which pods are handled
+	PodPhases []string
+	// RecheckInterval requeues pods that are not ready for their sidecars
+	// to be shut down yet after that delay, at most MaxRechecks times, in
+	// case the update of a later transition is missed. 0 disables it.
+	RecheckInterval time.Duration
+	MaxRechecks     int
+	// IgnorePodPhase handles pods whatever their phase, relying on the
+	// states of their containers alone
+	IgnorePodPhase bool
+	// EscalationGrace is how long a signaled sidecar may keep running
+	// before it is sent the KILL signal, 0 disables escalation
+	EscalationGrace time.Duration
+	// VerifyTermination checks that the signaled sidecars terminated, up to
+	// VerifyTerminationChecks times, before warning about those still
+	// running and sending them the KILL signal when escalation is enabled
+	VerifyTermination       bool
+	VerifyTerminationChecks int
+	// VerifyCommand is run in every signaled sidecar to confirm that its
+	// process exited, which it reports by exiting with a non-zero status,
+	// e.g. pgrep -f envoy. Empty disables it.
+	VerifyCommand string
+	// AllowEphemeralFallback signals sidecars without a shell or binary to
+	// run the shutdown command with from an ephemeral container running
+	// EphemeralImage, the DefaultEphemeralImage when empty
+	AllowEphemeralFallback bool
+	EphemeralImage         string
+	// PreShutdownWebhook is a URL the pod and its sidecars are posted to as
+	// JSON before they are shut down, the shutdown only proceeds when it
+	// answers 200 within PreShutdownWebhookTimeout and is asked again later
+	// otherwise
+	PreShutdownWebhook        string
+	PreShutdownWebhookTimeout time.Duration
+	// AutoDetectIstio adds the containers listed in the
+	// IstioStatusAnnotation of a pod to its sidecars
+	AutoDetectIstio bool
+	// EventComponent is the component the Events are attributed to,
+	// terminate-sidecar-job-controller when empty, and EventInstance
+	// identifies the instance recording them in the host of their source
+	EventComponent string
+	EventInstance  string
+	// Context is the kubeconfig context the controller runs against when
+	// one runs per context, it is appended to the name of its workqueue
+	Context string
+}
+
+// Validate checks the options for values the controller cannot work with
+func (o Options) Validate() error {
+	if _, err := newSidecarMatcher(o.SidecarMatchMode, o.Sidecars); err != nil {
+		return err
+	}
+	if strings.TrimSpace(o.ShutdownCommand) == "" {
+		return fmt.Errorf("shutdown command must not be empty")
+	}
+	if o.ShutdownDelay < 0 {
+		return fmt.Errorf("shutdown delay must not be negative")
+	}
+	if o.MaxRetries < 0 {
+		return fmt.Errorf("max retries must not be negative")
+	}
+	if o.DeletePodOnGiveUp && o.MaxRetries == 0 {
+		return fmt.Errorf("deleting pods on give up needs max retries to be set")
+	}
+	if o.DeleteGracePeriod < 0 {
+		return fmt.Errorf("delete grace period must not be negative")
+	}
+	if o.MaxWaitAfterCompletion < 0 {
+		return fmt.Errorf("max wait after completion must not be negative")
+	}
+	if o.RequeueBaseDelay <= 0 || o.RequeueMaxDelay < o.RequeueBaseDelay {
+		return fmt.Errorf("requeue delays must be positive with the max delay not below the base delay")
+	}
+	if o.RequeueJitter < 0 {
+		return fmt.Errorf("requeue jitter must not be negative")
+	}
+	if o.EscalationGrace < 0 {
+		return fmt.Errorf("escalation grace must not be negative")
+	}
+	if o.RecheckInterval < 0 || o.MaxRechecks < 0 {
+		return fmt.Errorf("recheck interval and max rechecks must not be negative")
+	}
+	if o.VerifyTermination && o.VerifyTerminationChecks <= 0 {
+		return fmt.Errorf("verify termination checks must be positive")
+	}
+	if o.ExecTimeout <= 0 {
+		return fmt.Errorf("exec timeout must be positive")
+	}
+	if o.SyncTimeout < 0 {
+		return fmt.Errorf("sync timeout must not be negative")
+	}
+	if o.MaxConcurrentExecs <= 0 {
+		return fmt.Errorf("max concurrent execs must be positive")
+	}
+	if newSetFromSlice(o.OwnerKinds).Len() == 0 {
+		return fmt.Errorf("at least one owner kind is required")
+	}
+	if !o.IgnorePodPhase && newSetFromSlice(o.PodPhases).Len() == 0 {
+		return fmt.Errorf("at least one pod phase is required")
+	}
+	switch o.ShutdownStrategy {
+	case ShutdownStrategySignal:
+	case ShutdownStrategyQuitQuitQuit:
+		if o.QuitPort <= 0 || o.QuitPort > 65535 {
+			return fmt.Errorf("invalid quitquitquit port %d", o.QuitPort)
+		}
+	default:
+		return fmt.Errorf("unknown shutdown strategy %q", o.ShutdownStrategy)
+	}
+	killProcess, err := parseKillTarget(o.KillTarget)
+	if err != nil {
+		return err
+	}
+	if killProcess != "" && o.DiscoverPIDByName != "" {
+		return fmt.Errorf("kill target %q and discovering the PID by name are mutually exclusive", o.KillTarget)
+	}
+	if o.PreShutdownWebhook != "" {
+		u, err := url.Parse(o.PreShutdownWebhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid pre-shutdown webhook URL %q", o.PreShutdownWebhook)
+		}
+		if o.PreShutdownWebhookTimeout <= 0 {
+			return fmt.Errorf("pre-shutdown webhook timeout must be positive")
+		}
+	}
+	switch o.SidecarMatchBy {
+	case SidecarMatchByName, SidecarMatchByImage:
+	default:
+		return fmt.Errorf("unknown sidecar match by %q", o.SidecarMatchBy)
+	}
+	switch o.AccountingMode {
+	case AccountingStrict, AccountingLenient:
+	default:
+		return fmt.Errorf("unknown accounting mode %q", o.AccountingMode)
+	}
+	switch o.RunningDetection {
+	case RunningDetectionReady, RunningDetectionState, RunningDetectionSidecarState:
+	default:
+		return fmt.Errorf("unknown running detection %q", o.RunningDetection)
+	}
+	switch o.ExecShell {
+	case ExecShellSh, ExecShellBash:
+	case ExecShellNone:
+		// These all rely on shell constructs
+		if o.ShutdownScript != "" {
+			return fmt.Errorf("a shutdown script needs a shell to run in")
+		}
+		if o.ShutdownStrategy != ShutdownStrategySignal {
+			return fmt.Errorf("the %s shutdown strategy needs a shell to run in", o.ShutdownStrategy)
+		}
+		if killProcess != "" {
+			return fmt.Errorf("kill target %q needs a shell to run in", o.KillTarget)
+		}
+		if o.DiscoverPIDByName != "" {
+			return fmt.Errorf("discovering the PID by name needs a shell to run in")
+		}
+	default:
+		return fmt.Errorf("unknown exec shell %q", o.ExecShell)
+	}
+	return nil
+}
+
+// parseKillTarget returns the process name of a KillTargetProcessPrefix kill
+// target, or an empty name for KillTargetPID1
+func parseKillTarget(target string) (string, error) {
+	if target == "" || target == KillTargetPID1 {
+		return "", nil
+	}
+	name, ok := strings.CutPrefix(target, KillTargetProcessPrefix)
+	if !ok {
+		return "", fmt.Errorf("unknown kill target %q", target)
+	}
+	if name == "" {
+		return "", fmt.Errorf("kill target %q is missing a process name", target)
+	}
+	return name, nil
+}
+
 // Controller is the controller implementation to manage pods
 type Controller struct {
 	// kubeclientset is a standard kubernetes clientset
 	kubeclientset kubernetes.Interface
+	// executor runs the shutdown commands in the sidecars
+	executor Executor
 
 	podsLister podlisters.PodLister
 	podsSynced cache.InformerSynced
+	// jobsSynced is set by WatchJobs
+	jobsSynced cache.InformerSynced
 
 	// workqueue is a rate limited work queue. This is used to queue work to be
 	// processed instead of performing it as soon as a change happens. This
@@ -75,28 +637,294 @@ type Controller struct {
 	// recorder is an event recorder for recording Event resources to the
 	// Kubernetes API.
 	recorder record.EventRecorder
+
+	// sidecarMatchMode is the match mode for the sidecar names
+	sidecarMatchMode string
+	// matchByImage matches the sidecar patterns against container images
+	matchByImage bool
+	// requireOptIn skips pods that are not explicitly enabled
+	requireOptIn bool
+	// shutdownStrategy selects how the sidecars are stopped
+	shutdownStrategy string
+	// quitPort is the port of the pilot-agent /quitquitquit endpoint
+	quitPort int
+	// execShell runs the shutdown command, ExecShellNone runs it as argv
+	execShell string
+	// shutdownScript is streamed to the sidecars instead of running the
+	// shutdown command when it is not empty
+	shutdownScript string
+	// killProcess is the name of the process signaled in the sidecars,
+	// PID 1 is signaled through the shutdown command when it is empty
+	killProcess string
+	// discoverPattern is a pgrep -f pattern for the processes signaled in
+	// the sidecars, used instead of PID 1 when it is not empty
+	discoverPattern string
+	// dryRun skips executing the shutdown command
+	dryRun bool
+	// reportOnly tracks the candidate pods instead of shutting sidecars
+	// down, candidates holds their keys and is guarded by candidatesLock
+	reportOnly     bool
+	candidatesLock sync.Mutex
+	candidates     stringSet
+	// watchNamespaces and excludeNamespaces are the namespace allow and deny
+	// lists
+	watchNamespaces   stringSet
+	excludeNamespaces stringSet
+	// shutdownOrder is the default order to shut sidecars down in
+	shutdownOrder []string
+	// drainTimeout bounds the wait for workers when shutting down
+	drainTimeout time.Duration
+	// maxRetries caps the requeues of a failing key
+	maxRetries int
+	// deletePodOnGiveUp deletes the pods the controller gives up on, with
+	// a grace period of deleteGracePeriod
+	deletePodOnGiveUp bool
+	deleteGracePeriod time.Duration
+	// maxWaitAfterCompletion bounds how long after the main containers
+	// finished the shutdown is retried
+	maxWaitAfterCompletion time.Duration
+	// ownerKinds is the set of controller Kinds whose pods are handled
+	ownerKinds stringSet
+	// nonControllerOwners falls back to owners that are not the controller
+	nonControllerOwners bool
+	// primaryContainer is the default primary container of the pods
+	primaryContainer string
+	// classifier decides the state of each container of a pod
+	classifier ContainerClassifier
+	// accountingMode is AccountingStrict or AccountingLenient
+	accountingMode string
+	// ignoreContainers is the set of containers left out of the accounting
+	ignoreContainers stringSet
+	// protectedContainers are accounted for like sidecars but never
+	// signaled
+	protectedContainers stringSet
+	// podPhases is the set of pod phases in which pods are handled, every
+	// phase is when ignorePodPhase is set
+	podPhases      stringSet
+	ignorePodPhase bool
+	// execTimeout bounds each exec into a sidecar, syncTimeout the whole
+	// sync of a pod
+	execTimeout time.Duration
+	syncTimeout time.Duration
+	// execSlots is a semaphore holding a token for every open exec
+	execSlots chan struct{}
+	// recheckInterval and maxRechecks bound the requeues of pods not ready
+	// for a shutdown yet
+	recheckInterval time.Duration
+	maxRechecks     int
+	// terminateOnMainFailure shuts sidecars down after main failures too
+	terminateOnMainFailure bool
+	// escalationGrace is the wait before KILL follows the shutdown command
+	escalationGrace time.Duration
+	// preShutdownWebhook is called through webhookClient before the
+	// sidecars of a pod are shut down when it is not empty
+	preShutdownWebhook string
+	webhookClient      *http.Client
+	// autoDetectIstio adds the containers istio injected to the sidecars
+	autoDetectIstio bool
+	// allowEphemeralFallback signals sidecars the shutdown command cannot
+	// run in from an ephemeral container running ephemeralImage
+	allowEphemeralFallback bool
+	ephemeralImage         string
+	// verifyChecks is the number of checks that the signaled sidecars
+	// terminated, 0 when they are not verified
+	verifyChecks int
+	// verifyCommand confirms that the process of a signaled sidecar
+	// exited, it is not run when empty
+	verifyCommand string
+
+	// liveConfig holds the settings that can be reloaded from a ConfigMap
+	// while the controller runs, it is guarded by liveConfigLock
+	liveConfigLock sync.RWMutex
+	liveConfig     liveConfig
+	// defaultConfig is the liveConfig built from the Options, it applies
+	// to the settings missing from the ConfigMap
+	defaultConfig liveConfig
+	// configReload debounces the reloads of the ConfigMap
+	configReload *time.Timer
+
+	// started is set once Run has been called, for the liveness check
+	started atomic.Bool
+	// execForbidden is set while the API server rejects the execs into
+	// the sidecars as forbidden, degrading the readiness
+	execForbidden atomic.Bool
+
+	// signaled remembers the UIDs of pods whose sidecars were already sent
+	// the shutdown command, covering the window before the
+	// SignaledAnnotation reaches the lister
+	signaled *utilcache.LRUExpireCache
+	// abandoned remembers the UIDs of pods the controller gave up on after
+	// maxWaitAfterCompletion
+	abandoned *utilcache.LRUExpireCache
+	// rechecks holds the number of rechecks scheduled for pods not ready
+	// for a shutdown yet, by UID
+	rechecks *utilcache.LRUExpireCache
+	// mismatched remembers the UIDs of pods already reported for a sidecar
+	// name mismatch
+	mismatched *utilcache.LRUExpireCache
+	// verifying holds the *verification of the pods whose signaled
+	// sidecars are checked for termination, by UID
+	verifying *utilcache.LRUExpireCache
+	// vetoed remembers the UIDs of pods whose shutdown the pre-shutdown
+	// webhook vetoed, so that the veto is recorded as an Event only once
+	vetoed *utilcache.LRUExpireCache
+}
+
+// discardRecorder is a record.EventRecorder dropping every Event
+type discardRecorder struct{}
+
+func (discardRecorder) Event(object runtime.Object, eventtype, reason, message string) {}
+
+func (discardRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+}
+
+func (discardRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+}
+
+// jitterRateLimiter adds up to maxFactor of random jitter to the delays of
+// its RateLimiter, capped at maxDelay, so that pods failing together are not
+// retried together
+type jitterRateLimiter struct {
+	workqueue.RateLimiter
+	maxFactor float64
+	maxDelay  time.Duration
+}
+
+// When implements workqueue.RateLimiter
+func (r jitterRateLimiter) When(item interface{}) time.Duration {
+	delay := wait.Jitter(r.RateLimiter.When(item), r.maxFactor)
+	if delay > r.maxDelay {
+		return r.maxDelay
+	}
+	return delay
+}
+
+// newRateLimiter returns the workqueue.DefaultControllerRateLimiter with the
+// given exponential backoff delays in place of its fixed ones, jittered by
+// up to the jitter fraction when it is positive
+func newRateLimiter(baseDelay, maxDelay time.Duration, jitter float64) workqueue.RateLimiter {
+	var backoff workqueue.RateLimiter = workqueue.NewItemExponentialFailureRateLimiter(baseDelay, maxDelay)
+	if jitter > 0 {
+		backoff = jitterRateLimiter{RateLimiter: backoff, maxFactor: jitter, maxDelay: maxDelay}
+	}
+	return workqueue.NewMaxOfRateLimiter(
+		backoff,
+		// 10 qps, 100 bucket size, the overall limit of the default
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+	)
 }
 
 // NewController returns a new controller
 func NewController(
 	ctx context.Context,
 	kubeclientset kubernetes.Interface,
-	podInformer podinformers.PodInformer) *Controller {
+	restConfig *rest.Config,
+	podInformer podinformers.PodInformer,
+	opts Options) (*Controller, error) {
 	logger := klog.FromContext(ctx)
 
+	sidecars, err := newSidecarMatcher(opts.SidecarMatchMode, opts.Sidecars)
+	if err != nil {
+		return nil, err
+	}
+
 	logger.V(4).Info("Creating event broadcaster")
 
-	eventBroadcaster := record.NewBroadcaster()
-	eventBroadcaster.StartStructuredLogging(0)
-	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeclientset.CoreV1().Events("")})
-	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
+	var recorder record.EventRecorder = discardRecorder{}
+	if !opts.DisableEvents {
+		eventBroadcaster := record.NewBroadcaster()
+		eventBroadcaster.StartStructuredLogging(0)
+		eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeclientset.CoreV1().Events("")})
+		component := opts.EventComponent
+		if component == "" {
+			component = controllerAgentName
+		}
+		recorder = eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component, Host: opts.EventInstance})
+	}
+
+	queueName := controllerAgentName
+	if opts.Context != "" {
+		queueName += "-" + opts.Context
+	}
 
 	controller := &Controller{
 		kubeclientset:     kubeclientset,
-		podsLister: podInformer.Lister(),
-		podsSynced: podInformer.Informer().HasSynced,
-		workqueue:         workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		executor:          opts.Executor,
+		podsLister:        podInformer.Lister(),
+		podsSynced:        podInformer.Informer().HasSynced,
+		workqueue:         workqueue.NewNamedRateLimitingQueue(newRateLimiter(opts.RequeueBaseDelay, opts.RequeueMaxDelay, opts.RequeueJitter), queueName),
 		recorder:          recorder,
+		sidecarMatchMode:  opts.SidecarMatchMode,
+		matchByImage:      opts.SidecarMatchBy == SidecarMatchByImage,
+		requireOptIn:      opts.RequireOptIn,
+		shutdownStrategy:  opts.ShutdownStrategy,
+		quitPort:          opts.QuitPort,
+		shutdownScript:    opts.ShutdownScript,
+		execShell:         opts.ExecShell,
+		discoverPattern:   opts.DiscoverPIDByName,
+		dryRun:            opts.DryRun,
+		reportOnly:        opts.ReportOnly,
+		candidates:        newStringSet(),
+		watchNamespaces:   newSetFromSlice(opts.WatchNamespaces),
+		excludeNamespaces: newSetFromSlice(opts.ExcludeNamespaces),
+		shutdownOrder:     opts.ShutdownOrder,
+		drainTimeout:      opts.DrainTimeout,
+		maxRetries:        opts.MaxRetries,
+		ownerKinds:        newSetFromSlice(opts.OwnerKinds),
+		podPhases:         newSetFromSlice(opts.PodPhases),
+		ignoreContainers:  newSetFromSlice(opts.IgnoreContainers),
+		classifier:        opts.ContainerClassifier,
+		accountingMode:    opts.AccountingMode,
+		primaryContainer:  opts.PrimaryContainer,
+		execTimeout:       opts.ExecTimeout,
+		syncTimeout:       opts.SyncTimeout,
+		execSlots:         make(chan struct{}, opts.MaxConcurrentExecs),
+		escalationGrace:   opts.EscalationGrace,
+		signaled:          utilcache.NewLRUExpireCache(signaledCacheSize),
+		abandoned:         utilcache.NewLRUExpireCache(signaledCacheSize),
+		verifying:         utilcache.NewLRUExpireCache(signaledCacheSize),
+		mismatched:        utilcache.NewLRUExpireCache(signaledCacheSize),
+		rechecks:          utilcache.NewLRUExpireCache(signaledCacheSize),
+		vetoed:            utilcache.NewLRUExpireCache(signaledCacheSize),
+
+		terminateOnMainFailure: opts.TerminateOnMainFailure,
+		maxWaitAfterCompletion: opts.MaxWaitAfterCompletion,
+		deletePodOnGiveUp:      opts.DeletePodOnGiveUp,
+		deleteGracePeriod:      opts.DeleteGracePeriod,
+		allowEphemeralFallback: opts.AllowEphemeralFallback,
+		autoDetectIstio:        opts.AutoDetectIstio,
+		preShutdownWebhook:     opts.PreShutdownWebhook,
+		nonControllerOwners:    opts.NonControllerOwners,
+		ignorePodPhase:         opts.IgnorePodPhase,
+		recheckInterval:        opts.RecheckInterval,
+		maxRechecks:            opts.MaxRechecks,
+		webhookClient:          &http.Client{Timeout: opts.PreShutdownWebhookTimeout},
+		ephemeralImage:         opts.EphemeralImage,
+	}
+	if controller.ephemeralImage == "" {
+		controller.ephemeralImage = DefaultEphemeralImage
+	}
+	if controller.classifier == nil {
+		controller.classifier = NewDefaultContainerClassifier(opts.SuccessExitCodes, opts.CompletedReasons, opts.RunningDetection)
+	}
+	controller.defaultConfig = liveConfig{
+		sidecars:        sidecars,
+		shutdownCommand: opts.ShutdownCommand,
+		shutdownDelay:   opts.ShutdownDelay,
+	}
+	controller.liveConfig = controller.defaultConfig
+
+	if opts.VerifyTermination {
+		controller.verifyChecks = opts.VerifyTerminationChecks
+	}
+	controller.protectedContainers = newSetFromSlice(opts.ProtectedContainers)
+	controller.verifyCommand = strings.TrimSpace(opts.VerifyCommand)
+
+	// Validate already rejected malformed kill targets
+	controller.killProcess, _ = parseKillTarget(opts.KillTarget)
+
+	if controller.executor == nil {
+		controller.executor = NewSPDYExecutor(kubeclientset, restConfig)
 	}
 
 	logger.Info("Setting up event handlers")
@@ -106,17 +934,19 @@ func NewController(
 		UpdateFunc: func(old, new interface{}) {
 			newPod := new.(*corev1.Pod)
 			oldPod := old.(*corev1.Pod)
-			if newPod.ResourceVersion == oldPod.ResourceVersion {
-				// Periodic resync will send update events for all known Deployments.
-				// Two different versions of the same Deployment will always have different RVs.
-				return
+			// Periodic resync will send update events for all known pods,
+			// with an unchanged RV. These are handled so that a pod whose
+			// transition was missed, e.g. during a restart, is evaluated
+			// again. Pods are only ever signaled once. Of the real updates
+			// only the ones where a main container finished matter.
+			if resync := newPod.ResourceVersion == oldPod.ResourceVersion; resync || controller.mainContainerTerminated(oldPod, newPod) {
+				controller.handlePod(new, resync)
 			}
-			controller.handleObject(new)
 		},
 		DeleteFunc: controller.handleDeleteObject,
 	})
 
-	return controller
+	return controller, nil
 }
 
 // Run will set up the event handlers for types we are interested in, as well
@@ -125,8 +955,8 @@ func NewController(
 // workers to finish processing their current work items.
 func (c *Controller) Run(ctx context.Context, workers int) error {
 	defer utilruntime.HandleCrash()
-	defer c.workqueue.ShutDown()
 	logger := klog.FromContext(ctx)
+	c.started.Store(true)
 
 	// Start the informer factories to begin populating the informer caches
 	logger.Info("Starting Terminate Sidecar controller")
@@ -134,23 +964,85 @@ func (c *Controller) Run(ctx context.Context, workers int) error {
 	// Wait for the caches to be synced before starting workers
 	logger.Info("Waiting for informer caches to sync")
 
-	if ok := cache.WaitForCacheSync(ctx.Done(), c.podsSynced); !ok {
+	cacheSyncs := []cache.InformerSynced{c.podsSynced}
+	if c.jobsSynced != nil {
+		cacheSyncs = append(cacheSyncs, c.jobsSynced)
+	}
+	if ok := cache.WaitForCacheSync(ctx.Done(), cacheSyncs...); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
 	logger.Info("Starting workers", "count", workers)
-	// Launch two workers to process Foo resources
+	// The syncs run with a context of their own, so that stopping the
+	// controller lets them finish rather than aborting the execs midway.
+	// It is only cancelled once drainTimeout elapsed.
+	syncCtx, cancelSyncs := context.WithCancel(withoutCancel{ctx})
+	defer cancelSyncs()
+	// Launch the workers to process Pod resources
+	var wg sync.WaitGroup
 	for i := 0; i < workers; i++ {
-		go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait.UntilWithContext(ctx, func(context.Context) {
+				c.runWorker(syncCtx)
+			}, time.Second)
+		}()
 	}
 
 	logger.Info("Started workers")
 	<-ctx.Done()
 	logger.Info("Shutting down workers")
 
+	// Shutting down the workqueue stops the workers once they are done with
+	// their current item, give them drainTimeout to get there
+	c.workqueue.ShutDown()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logger.Info("Workers finished")
+	case <-time.After(c.drainTimeout):
+		logger.Info("Timed out waiting for workers to finish, cancelling their syncs", "timeout", c.drainTimeout)
+		cancelSyncs()
+		<-done
+	}
+
 	return nil
 }
 
+// withoutCancel is a context carrying the values of its parent, such as the
+// logger, but neither its deadline nor its cancellation. It stands in for
+// context.WithoutCancel, which needs Go 1.21.
+type withoutCancel struct {
+	context.Context
+}
+
+func (withoutCancel) Deadline() (deadline time.Time, ok bool) { return }
+func (withoutCancel) Done() <-chan struct{}                   { return nil }
+func (withoutCancel) Err() error                              { return nil }
+
+// Started reports whether Run has been called
+func (c *Controller) Started() bool {
+	return c.started.Load()
+}
+
+// Synced reports whether the informer caches have synced. It does not
+// depend on Run, standby replicas under leader election keep their caches
+// in sync without running the workers.
+func (c *Controller) Synced() bool {
+	return c.podsSynced() && (c.jobsSynced == nil || c.jobsSynced())
+}
+
+// Degraded reports whether the controller is not allowed to exec into the
+// sidecars, which it cannot shut down until its RBAC is fixed
+func (c *Controller) Degraded() bool {
+	return c.execForbidden.Load()
+}
+
 // runWorker is a long-running function that will continually call the
 // processNextWorkItem function in order to read and process a message on the
 // workqueue.
@@ -193,8 +1085,48 @@ func (c *Controller) processNextWorkItem(ctx context.Context) bool {
 			utilruntime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
 			return nil
 		}
+		// Bound the whole sync so a pod with many slow sidecars cannot hold
+		// the worker forever
+		syncCtx := ctx
+		if c.syncTimeout > 0 {
+			var cancel context.CancelFunc
+			syncCtx, cancel = context.WithTimeout(ctx, c.syncTimeout)
+			defer cancel()
+		}
 		// Run the syncHandler, passing it the namespace/name string of the
-		if err := c.syncHandler(ctx, key); err != nil {
+		if err := c.syncHandler(syncCtx, key); err != nil {
+			if errors.Is(syncCtx.Err(), context.DeadlineExceeded) {
+				logger.Info("Sync timed out, requeuing", "resourceName", key, "timeout", c.syncTimeout)
+			}
+			// The webhook holds the shutdown back on purpose, ask it again
+			// later without counting the veto as a failure
+			var vetoed *shutdownVetoedError
+			if errors.As(err, &vetoed) {
+				c.workqueue.Forget(obj)
+				c.workqueue.AddAfter(key, shutdownVetoedBackoff)
+				return fmt.Errorf("error syncing '%s': %s, asking again in %s", key, err.Error(), shutdownVetoedBackoff)
+			}
+			// Missing exec permissions affect every pod, retry them
+			// rarely until the RBAC is fixed rather than dropping them
+			if c.Degraded() && permanentError(err) {
+				c.workqueue.Forget(obj)
+				c.workqueue.AddAfter(key, execForbiddenBackoff)
+				return fmt.Errorf("error syncing '%s': %s, exec is forbidden, retrying in %s", key, err.Error(), execForbiddenBackoff)
+			}
+			// Requeuing cannot fix errors such as missing permissions, make
+			// them visible on the pod instead of looping on them
+			if permanentError(err) {
+				c.workqueue.Forget(obj)
+				c.recordPermanentFailure(key, err)
+				return fmt.Errorf("error syncing '%s': %s, not retrying", key, err.Error())
+			}
+			// Give up on items that keep failing, the sidecar most likely
+			// cannot be shut down by the controller at all
+			if c.maxRetries > 0 && c.workqueue.NumRequeues(key) >= c.maxRetries {
+				c.workqueue.Forget(obj)
+				c.giveUp(ctx, key, err)
+				return fmt.Errorf("error syncing '%s': %s, giving up after %d retries", key, err.Error(), c.maxRetries)
+			}
 			// Put the item back on the workqueue to handle any transient errors.
 			c.workqueue.AddRateLimited(key)
 			return fmt.Errorf("error syncing '%s': %s, requeuing", key, err.Error())
@@ -214,6 +1146,78 @@ func (c *Controller) processNextWorkItem(ctx context.Context) bool {
 	return true
 }
 
+// permanentError reports whether err is an API error that retrying cannot
+// fix: authentication, authorization and validation failures, and pods that
+// no longer exist. Everything else, such as timeouts and server errors, is
+// considered transient. An aggregate is permanent only when all of its errors
+// are.
+func permanentError(err error) bool {
+	var agg utilerrors.Aggregate
+	if errors.As(err, &agg) {
+		for _, err := range agg.Errors() {
+			if !permanentError(err) {
+				return false
+			}
+		}
+		return len(agg.Errors()) > 0
+	}
+	return apierrors.IsUnauthorized(err) ||
+		apierrors.IsForbidden(err) ||
+		apierrors.IsNotFound(err) ||
+		apierrors.IsBadRequest(err) ||
+		apierrors.IsInvalid(err) ||
+		apierrors.IsMethodNotSupported(err)
+}
+
+// recordPermanentFailure records a Warning Event on the pod behind key for an
+// error it is not retried for
+func (c *Controller) recordPermanentFailure(key string, err error) {
+	namespace, name, splitErr := cache.SplitMetaNamespaceKey(key)
+	if splitErr != nil {
+		return
+	}
+	pod, getErr := c.podsLister.Pods(namespace).Get(name)
+	if getErr != nil {
+		return
+	}
+	c.recorder.Eventf(pod, corev1.EventTypeWarning, ShutdownFailedPermanently, MessageShutdownFailedPermanently, err)
+}
+
+// giveUp emits a Warning Event on the pod behind key when the controller
+// stops retrying it, and deletes the pod when deletePodOnGiveUp is set
+func (c *Controller) giveUp(ctx context.Context, key string, err error) {
+	namespace, name, splitErr := cache.SplitMetaNamespaceKey(key)
+	if splitErr != nil {
+		return
+	}
+	pod, getErr := c.podsLister.Pods(namespace).Get(name)
+	if getErr != nil {
+		return
+	}
+	c.recorder.Eventf(pod, corev1.EventTypeWarning, MaxRetriesExceeded, MessageMaxRetriesExceeded, c.maxRetries, err)
+	if !c.deletePodOnGiveUp {
+		return
+	}
+
+	logger := klog.FromContext(ctx)
+	gracePeriod := int64(c.deleteGracePeriod.Seconds())
+	if c.dryRun {
+		logger.Info("Dry run, skipping deletion of pod", "pod", klog.KObj(pod), "gracePeriod", gracePeriod)
+		return
+	}
+	// Deleting is destructive, announce it on the pod first
+	c.recorder.Eventf(pod, corev1.EventTypeWarning, DeletingPod, MessageDeletingPod, gracePeriod)
+	logger.Info("Deleting pod after giving up on its sidecars", "pod", klog.KObj(pod), "gracePeriod", gracePeriod)
+	err = c.kubeclientset.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{
+		GracePeriodSeconds: &gracePeriod,
+		// Do not delete a pod recreated under the same name meanwhile
+		Preconditions: metav1.NewUIDPreconditions(string(pod.UID)),
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		utilruntime.HandleError(fmt.Errorf("error deleting pod '%s': %w", key, err))
+	}
+}
+
 // syncHandler compares the actual state with the desired, and attempts to
 // converge the two.
 func (c *Controller) syncHandler(ctx context.Context, key string) error {
@@ -226,49 +1230,381 @@ func (c *Controller) syncHandler(ctx context.Context, key string) error {
 		return nil
 	}
 
+	// In report-only mode every evaluation updates whether the pod is a
+	// candidate for a shutdown
+	candidate := false
+	if c.reportOnly {
+		defer func() { c.setCandidate(key, candidate) }()
+	}
+
 	// Get the pod with the name
 	pod, err := c.podsLister.Pods(namespace).Get(name)
-
+	if apierrors.IsNotFound(err) {
+		// The pod is gone, there is nothing left to shut down
+		logger.V(4).Info("Pod no longer exists, skipping", "pod", name)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	podsProcessed.Inc()
+
+	// Pods of indexed Jobs carry their completion index, which makes them
+	// easier to correlate in the logs of the shutdown
+	if index, ok := pod.Annotations[batchv1.JobCompletionIndexAnnotation]; ok {
+		logger = klog.LoggerWithValues(logger, "completionIndex", index)
+		ctx = klog.NewContext(ctx, klog.LoggerWithValues(klog.FromContext(ctx), "completionIndex", index))
+	}
 
-	sidecars := set.NewSet()
-	sidecars.Add("istio-proxy")
-	allContainers := set.NewSet()
-	runningContainers := set.NewSet()
-	completedContainers := set.NewSet()
+	// Exec'ing into a pod that is being deleted races with its deletion
+	if pod.DeletionTimestamp != nil {
+		logger.V(4).Info("Pod is being deleted, skipping", "pod", pod.Name)
+		podsSkipped.WithLabelValues(skipDeleting).Inc()
+		return nil
+	}
 
-	for _, containerStatus := range pod.Status.ContainerStatuses {
-		allContainers.Add(containerStatus.Name)
+	if v, ok := c.verifying.Get(pod.UID); ok {
+		c.verifyTermination(ctx, key, pod, v.(*verification))
+		return nil
+	}
 
-		if containerStatus.Ready {
-			runningContainers.Add(containerStatus.Name)
-		} else {
-			terminated := containerStatus.State.Terminated
-			if terminated != nil && (terminated.Reason == "Completed" || terminated.Reason == "Error") {
-				completedContainers.Add(containerStatus.Name)
+	if c.alreadySignaled(pod) {
+		logger.V(4).Info("Sidecars were already signaled, skipping", "pod", pod.Name)
+		podsSkipped.WithLabelValues(skipAlreadySignaled).Inc()
+		return nil
+	}
+
+	if _, ok := c.abandoned.Get(pod.UID); ok {
+		logger.V(4).Info("Gave up on the sidecars, skipping", "pod", pod.Name)
+		podsSkipped.WithLabelValues(skipAbandoned).Inc()
+		return nil
+	}
+
+	sidecars, err := c.sidecarsForPod(pod)
+	if err != nil {
+		// An invalid annotation will not fix itself, so do not requeue
+		utilruntime.HandleError(fmt.Errorf("pod '%s': %w", key, err))
+		return nil
+	}
+	if sidecars.Len() == 0 {
+		logger.V(4).Info("Pod declares no sidecars, skipping", "pod", pod.Name)
+		podsSkipped.WithLabelValues(skipNoSidecars).Inc()
+		return nil
+	}
+
+	if pod.Annotations[KeepSidecarsAnnotation] == "true" {
+		c.explainSkip(ctx, pod, "the pod asks to keep its sidecars")
+		podsSkipped.WithLabelValues(skipKeepSidecars).Inc()
+		return nil
+	}
+
+	eval := c.evaluatePod(pod, sidecars)
+	logger.V(3).Info("Evaluated containers", "pod", pod.Name, "all", eval.all,
+		"running", eval.running, "completed", eval.completed, "sidecars", sidecars)
+
+	if !eval.shouldShutdown() {
+		c.explainSkip(ctx, pod, eval.skipReason)
+		podsSkipped.WithLabelValues(skipNotEligible).Inc()
+		c.checkNameMismatch(ctx, pod, eval, sidecars)
+		c.scheduleRecheck(ctx, key, pod)
+	} else if c.reportOnly {
+		logger.Info("Report only, not shutting down sidecars", "pod", pod.Name, "containers", eval.targets)
+		candidate = true
+	} else {
+		// Give the pod its grace period, the key is checked again once
+		// it has elapsed
+		finishedAt := eval.finishedAt
+		if remaining := c.config().shutdownDelay - time.Since(finishedAt); remaining > 0 {
+			logger.V(4).Info("Delaying shutdown", "pod", pod.Name, "remaining", remaining)
+			c.workqueue.AddAfter(key, remaining)
+			return nil
+		}
+		if c.preShutdownWebhook != "" && !c.dryRun {
+			// Vetoes are asked again later, errors are retried like a
+			// failed shutdown, the sidecars are never shut down without
+			// the webhook's consent
+			if err := c.callPreShutdownWebhook(ctx, pod, eval.targets); err != nil {
+				return err
+			}
+		}
+		logger.Info("Sending shutdown signal to containers", "pod", pod.Name, "containers", eval.targets)
+		results, err := c.sendShutdownSignal(ctx, pod, eval.targets, finishedAt)
+		c.recordShutdownResults(pod, results)
+		c.annotateResults(ctx, pod, results)
+		if err != nil {
+			// Sidecars that keep refusing to stop this long after the
+			// main containers finished will not stop by retrying
+			if waited := time.Since(finishedAt); c.maxWaitAfterCompletion > 0 && !finishedAt.IsZero() &&
+				waited > c.maxWaitAfterCompletion {
+				logger.Error(err, "Giving up shutting down sidecars", "pod", pod.Name, "waited", waited)
+				c.recorder.Eventf(pod, corev1.EventTypeWarning, ShutdownTimedOut, MessageShutdownTimedOut,
+					waited.Round(time.Second), err)
+				c.abandoned.Add(pod.UID, struct{}{}, signaledCacheTTL)
+				return nil
 			}
+			return err
 		}
+		c.markSignaled(ctx, pod)
+		c.verifyProcesses(ctx, pod, results)
+		c.startVerification(key, pod, results)
+	}
+
+	logger.V(4).Info("Pod synced", "pod", pod.Name)
+	return nil
+}
+
+// explainSkip records why the sidecars of the pod are not being shut down,
+// at V(3) and, for pods carrying the DebugAnnotation, as an Event
+func (c *Controller) explainSkip(ctx context.Context, pod *corev1.Pod, reason string) {
+	klog.FromContext(ctx).V(3).Info("Not shutting down sidecars", "pod", klog.KObj(pod), "reason", reason)
+	if pod.Annotations[DebugAnnotation] == "true" {
+		c.recorder.Event(pod, corev1.EventTypeNormal, SidecarShutdownSkipped, reason)
+	}
+}
+
+// scheduleRecheck requeues a pod that is not ready for its sidecars to be
+// shut down yet after the recheck interval, so that a transition whose
+// update was missed is still acted on. A pod is requeued at most maxRechecks
+// times.
+func (c *Controller) scheduleRecheck(ctx context.Context, key string, pod *corev1.Pod) {
+	if c.recheckInterval <= 0 {
+		return
+	}
+	rechecks := 0
+	if v, ok := c.rechecks.Get(pod.UID); ok {
+		rechecks = v.(int)
+	}
+	if rechecks >= c.maxRechecks {
+		klog.FromContext(ctx).V(4).Info("Not rechecking pod anymore", "pod", klog.KObj(pod), "rechecks", rechecks)
+		return
+	}
+	c.rechecks.Add(pod.UID, rechecks+1, signaledCacheTTL)
+	c.workqueue.AddAfter(key, c.recheckInterval)
+}
+
+// checkNameMismatch reports pods whose only running container is not a
+// sidecar while all their other containers completed. Such a pod is most
+// likely running a sidecar under a name the controller does not know about.
+// Every pod is reported once.
+func (c *Controller) checkNameMismatch(ctx context.Context, pod *corev1.Pod, eval podEvaluation, sidecars stringSet) {
+	if eval.running.Len() != 1 || eval.running.IsSubset(sidecars.Union(c.protectedContainers)) || eval.completed.Len() == 0 ||
+		!eval.running.Union(eval.completed).Equal(eval.all) {
+		return
+	}
+	if _, ok := c.mismatched.Get(pod.UID); ok {
+		return
+	}
+	c.mismatched.Add(pod.UID, struct{}{}, signaledCacheTTL)
+	container := eval.running.ToSlice()[0]
+	klog.FromContext(ctx).Info("Only running container is not a sidecar, the sidecar names may be misconfigured",
+		"pod", klog.KObj(pod), "container", container, "sidecars", sidecars)
+	sidecarNameMismatch.Inc()
+	c.recorder.Eventf(pod, corev1.EventTypeNormal, SidecarNameMismatch, MessageSidecarNameMismatch, container, sidecars)
+}
+
+// namespaceAllowed reports whether pods in the namespace should be handled
+// according to the namespace allow and deny lists
+func (c *Controller) namespaceAllowed(namespace string) bool {
+	if c.excludeNamespaces.Contains(namespace) {
+		return false
+	}
+	return c.watchNamespaces.Len() == 0 || c.watchNamespaces.Contains(namespace)
+}
+
+// alreadySignaled reports whether the sidecars of the pod have already been
+// sent the shutdown command
+func (c *Controller) alreadySignaled(pod *corev1.Pod) bool {
+	if _, ok := pod.Annotations[SignaledAnnotation]; ok {
+		return true
 	}
+	_, ok := c.signaled.Get(pod.UID)
+	return ok
+}
 
-	logger.Info("all", allContainers)
-	logger.Info("running", runningContainers)
-	logger.Info("completed", completedContainers)
-	logger.Info("sidecars", sidecars)
+// markSignaled records that the sidecars of the pod have been sent the
+// shutdown command, both in memory and as the SignaledAnnotation on the pod
+// so that the mark survives controller restarts. Pods are only marked in
+// memory in dry-run mode.
+func (c *Controller) markSignaled(ctx context.Context, pod *corev1.Pod) {
+	logger := klog.FromContext(ctx)
+	c.signaled.Add(pod.UID, struct{}{}, signaledCacheTTL)
+	if c.dryRun {
+		return
+	}
 
-	// If we have accounted for all of the containers, and the sidecar containers are the only
-	// ones still running, issue them each a shutdown command
-	if runningContainers.Union(completedContainers).Equal(allContainers) {
-		logger.Info("  We have all the containers")
-		if runningContainers.Equal(sidecars) {
-			logger.Info("    Sending shutdown signal to containers: ", pod.Name, sidecars)
-			c.sendShutdownSignal(ctx, pod, sidecars)
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				SignaledAnnotation: time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	_, err = c.kubeclientset.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		logger.Error(err, "Error annotating pod as signaled", "pod", klog.KObj(pod))
+	}
+}
+
+// sidecarsForPod returns the set of sidecar container names for the pod. The
+// SidecarsAnnotation takes precedence over the controller default, an empty
+// annotation value yields an empty set. Native sidecars are always included
+// unless the annotation is empty.
+func (c *Controller) sidecarsForPod(pod *corev1.Pod) (stringSet, error) {
+	matcher := c.config().sidecars
+	if value, ok := pod.Annotations[SidecarsAnnotation]; ok {
+		var err error
+		matcher, err = newSidecarMatcher(c.sidecarMatchMode, strings.Split(value, ","))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", SidecarsAnnotation, err)
+		}
+		if matcher.Empty() {
+			return newStringSet(), nil
 		}
 	}
 
-	c.recorder.Event(pod, corev1.EventTypeNormal, SuccessSynced, MessageResourceSynced)
-	return nil
+	sidecars := nativeSidecars(pod)
+	var injected stringSet
+	if c.autoDetectIstio {
+		injected = istioSidecars(pod)
+	}
+	for _, container := range pod.Spec.Containers {
+		subject := container.Name
+		if c.matchByImage {
+			subject = container.Image
+		}
+		if matcher.Match(subject) || injected.Contains(container.Name) {
+			sidecars.Add(container.Name)
+		}
+	}
+	return sidecars, nil
+}
+
+// istioSidecars returns the containers istio records as injected in the
+// IstioStatusAnnotation of the pod. A malformed annotation is logged and
+// yields no containers.
+func istioSidecars(pod *corev1.Pod) stringSet {
+	s := newStringSet()
+	value, ok := pod.Annotations[IstioStatusAnnotation]
+	if !ok {
+		return s
+	}
+	var status struct {
+		Containers []string `json:"containers"`
+	}
+	if err := json.Unmarshal([]byte(value), &status); err != nil {
+		klog.FromContext(context.Background()).Info("Ignoring malformed istio status annotation", "pod", klog.KObj(pod),
+			"annotation", IstioStatusAnnotation, "err", err)
+		return s
+	}
+	for _, container := range status.Containers {
+		s.Add(container)
+	}
+	return s
+}
+
+// nativeSidecars returns the names of the init containers of the pod with a
+// restartPolicy of Always, which Kubernetes runs as sidecars alongside the
+// regular containers
+func nativeSidecars(pod *corev1.Pod) stringSet {
+	s := newStringSet()
+	for _, container := range pod.Spec.InitContainers {
+		if container.RestartPolicy != nil && *container.RestartPolicy == corev1.ContainerRestartPolicyAlways {
+			s.Add(container.Name)
+		}
+	}
+	return s
+}
+
+// newSetFromSlice builds a set from a list of names, trimming whitespace and
+// dropping empty entries
+func newSetFromSlice(names []string) stringSet {
+	s := newStringSet()
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			s.Add(name)
+		}
+	}
+	return s
+}
+
+// lastFinishedAt returns the time the last of the terminated non-sidecar
+// containers finished
+func lastFinishedAt(statuses []corev1.ContainerStatus, sidecars stringSet) time.Time {
+	var last time.Time
+	for _, containerStatus := range statuses {
+		if sidecars.Contains(containerStatus.Name) {
+			continue
+		}
+		terminated := containerStatus.State.Terminated
+		if terminated != nil && terminated.FinishedAt.Time.After(last) {
+			last = terminated.FinishedAt.Time
+		}
+	}
+	return last
+}
+
+// mainContainerTerminated reports whether a non-sidecar container of the pod
+// entered the terminated state between the old and new version of the pod
+func (c *Controller) mainContainerTerminated(oldPod, newPod *corev1.Pod) bool {
+	sidecars, err := c.sidecarsForPod(newPod)
+	if err != nil {
+		// Let syncHandler report the invalid annotation
+		return true
+	}
+
+	wasTerminated := newStringSet()
+	for _, containerStatus := range oldPod.Status.ContainerStatuses {
+		if containerStatus.State.Terminated != nil {
+			wasTerminated.Add(containerStatus.Name)
+		}
+	}
+	for _, containerStatus := range newPod.Status.ContainerStatuses {
+		if sidecars.Contains(containerStatus.Name) || wasTerminated.Contains(containerStatus.Name) {
+			continue
+		}
+		if containerStatus.State.Terminated != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// setCandidate records whether the pod behind key is a candidate for a
+// shutdown in report-only mode
+func (c *Controller) setCandidate(key string, candidate bool) {
+	c.candidatesLock.Lock()
+	defer c.candidatesLock.Unlock()
+	// Several controllers share the gauge, so it is moved by the changes
+	// rather than set
+	switch {
+	case candidate && !c.candidates.Contains(key):
+		c.candidates.Add(key)
+		sidecarCandidates.Inc()
+	case !candidate && c.candidates.Contains(key):
+		delete(c.candidates, key)
+		sidecarCandidates.Dec()
+	}
+}
+
+// Resync runs every pod in the informer cache through handlePod again,
+// for pods whose last update was handled before a ConfigMap reload or an
+// outage that kept their sidecars running. Pods not owned by one of the
+// owner kinds are filtered out as on any update. It returns the number of
+// pods looked at.
+func (c *Controller) Resync(ctx context.Context) (int, error) {
+	pods, err := c.podsLister.List(labels.Everything())
+	if err != nil {
+		return 0, fmt.Errorf("error listing pods: %w", err)
+	}
+	klog.FromContext(ctx).Info("Resyncing pods", "pods", len(pods))
+	for _, pod := range pods {
+		c.handlePod(pod, true)
+	}
+	return len(pods), nil
 }
 
 // enqueuePod takes a Pod resource and converts it into a namespace/name
@@ -288,8 +1624,14 @@ func (c *Controller) enqueuePod(obj interface{}) {
 // to find the Pod resource that 'owns' it. It does this by looking at the
 // objects metadata.ownerReferences field for an appropriate OwnerReference.
 // It then enqueues that Pod resource to be processed. If the pod is not Owned
-// ny a Job it will be skipped
+// by a Job, or one of the other configured owner kinds, it will be skipped
 func (c *Controller) handleObject(obj interface{}) {
+	c.handlePod(obj, false)
+}
+
+// handlePod implements handleObject. resync tells that the pod did not
+// change since it was last handled, as on the periodic resyncs.
+func (c *Controller) handlePod(obj interface{}, resync bool) {
 	var object metav1.Object
 	var ok bool
 	logger := klog.FromContext(context.Background())
@@ -307,87 +1649,681 @@ func (c *Controller) handleObject(obj interface{}) {
 		logger.V(4).Info("Recovered deleted object", "resourceName", object.GetName())
 	}
 	logger.V(4).Info("Processing object", "object", klog.KObj(object))
-	if ownerRef := metav1.GetControllerOf(object); ownerRef != nil {
-		// If this object is not owned by a Job, we should not do anything more
-		// with it.
-		if ownerRef.Kind != "Job" {
-			return
+	// If this object is not owned by a Job, or one of the other
+	// configured owner kinds, we should not do anything more with it
+	// unless it is forced in.
+	ownerRef := c.ownerOf(object)
+	owned := ownerRef != nil && c.ownerKinds.Contains(ownerRef.Kind)
+	if !owned && object.GetAnnotations()[ForceAnnotation] != "true" {
+		// Every pod of the cluster comes by on each resync, only count
+		// the ones that changed
+		if !resync {
+			podsSkipped.WithLabelValues(skipNotOwned).Inc()
 		}
+		return
+	}
+
+	if !c.namespaceAllowed(object.GetNamespace()) {
+		logger.V(4).Info("Namespace is not watched", "object", klog.KObj(object))
+		podsSkipped.WithLabelValues(skipNamespaceExcluded).Inc()
+		return
+	}
 
-		pod, err := c.podsLister.Pods(object.GetNamespace()).Get(object.GetName())
+	pod, err := c.podsLister.Pods(object.GetNamespace()).Get(object.GetName())
 
-		if err != nil {
-			logger.V(4).Info("Ignore orphaned object", "object", klog.KObj(object), "pod", ownerRef.Name)
+	if err != nil {
+		logger.V(4).Info("Ignore orphaned object", "object", klog.KObj(object))
+		podsSkipped.WithLabelValues(skipNotFound).Inc()
+		return
+	}
+
+	if pod.DeletionTimestamp != nil {
+		logger.V(4).Info("Pod is being deleted", "pod", pod.Name)
+		podsSkipped.WithLabelValues(skipDeleting).Inc()
+		return
+	}
+
+	if !c.ignorePodPhase && !c.podPhases.Contains(string(pod.Status.Phase)) {
+		logger.V(4).Info("Pod is not in a handled phase", "pod", pod.Name, "phase", pod.Status.Phase)
+		podsSkipped.WithLabelValues(skipNotRunning).Inc()
+		return
+	}
+
+	if c.requireOptIn && pod.Annotations[EnabledAnnotation] != "true" {
+		logger.V(4).Info("Pod has not opted in", "pod", pod.Name)
+		podsSkipped.WithLabelValues(skipOptOut).Inc()
+		return
+	}
+
+	if pod.Annotations[DisabledAnnotation] == "true" {
+		logger.V(4).Info("Pod is disabled", "pod", pod.Name)
+		podsSkipped.WithLabelValues(skipOptOut).Inc()
+		return
+	}
+
+	if !owned {
+		logger.V(4).Info("Pod is forced in", "pod", pod.Name)
+	}
+	c.enqueuePod(pod)
+}
+
+// ownerOf returns the controller of the object. With nonControllerOwners an
+// object without a controller falls back to its first owner of one of the
+// handled kinds.
+func (c *Controller) ownerOf(object metav1.Object) *metav1.OwnerReference {
+	if ownerRef := metav1.GetControllerOf(object); ownerRef != nil || !c.nonControllerOwners {
+		return ownerRef
+	}
+	for _, ownerRef := range object.GetOwnerReferences() {
+		if c.ownerKinds.Contains(ownerRef.Kind) {
+			return &ownerRef
+		}
+	}
+	return nil
+}
+
+// handleDeleteObject drops the state kept for a deleted pod, so that it does
+// not grow without bounds on clusters with many short lived pods
+func (c *Controller) handleDeleteObject(obj interface{}) {
+	object, ok := obj.(metav1.Object)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("error decoding object, invalid type"))
 			return
 		}
+		object, ok = tombstone.Obj.(metav1.Object)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("error decoding object tombstone, invalid type"))
+			return
+		}
+	}
+	key, err := cache.MetaNamespaceKeyFunc(object)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	klog.FromContext(context.Background()).V(4).Info("Forgetting deleted pod", "pod", klog.KObj(object))
+	c.signaled.Remove(object.GetUID())
+	c.abandoned.Remove(object.GetUID())
+	c.verifying.Remove(object.GetUID())
+	c.mismatched.Remove(object.GetUID())
+	c.rechecks.Remove(object.GetUID())
+	c.vetoed.Remove(object.GetUID())
+	if c.reportOnly {
+		c.setCandidate(key, false)
+	}
+	// Reset the retry count of the key, a pod created later under the same
+	// name starts afresh
+	c.workqueue.Forget(key)
+}
+
+// buildShutdownCommand returns the shell command that stops a sidecar
+// according to the configured shutdown strategy
+func (c *Controller) buildShutdownCommand() string {
+	shutdownCommand := c.config().shutdownCommand
+	if c.killProcess != "" || c.discoverPattern != "" {
+		shutdownCommand = c.killCommand("TERM")
+	}
+	if c.shutdownStrategy != ShutdownStrategyQuitQuitQuit {
+		return shutdownCommand
+	}
+	return fmt.Sprintf("if command -v curl >/dev/null 2>&1; then curl -sf -X POST http://localhost:%d/quitquitquit; else %s; fi",
+		c.quitPort, shutdownCommand)
+}
+
+// killCommand returns the shell command that sends signal to the kill
+// target of the sidecars
+func (c *Controller) killCommand(signal string) string {
+	switch {
+	case c.killProcess != "":
+		return c.killProcessCommand(signal)
+	case c.discoverPattern != "":
+		return c.discoverPIDCommand(signal)
+	default:
+		return "kill -s " + signal + " 1"
+	}
+}
 
-		if pod.Status.Phase != "Running" {
-			logger.V(4).Info("Pod is not running", "pod", pod.Name)
+// discoverPIDCommand returns the shell command that sends signal to the
+// processes whose command line matches discoverPattern. When none matches it
+// logs that to stderr and succeeds without signaling anything, PID 1 in
+// particular. The pattern is spelled with printf escapes so that the command
+// line of the shell itself does not match it.
+func (c *Controller) discoverPIDCommand(signal string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(c.discoverPattern) {
+		fmt.Fprintf(&escaped, "\\%03o", b)
+	}
+	return fmt.Sprintf("pattern=\"$(printf '%s')\"; pids=$(pgrep -f -- \"$pattern\"); "+
+		"if [ -z \"$pids\" ]; then echo \"no process matches $pattern, skipping\" >&2; exit 0; fi; "+
+		"kill -s %s $pids", escaped.String(), signal)
+}
+
+// killProcessCommand returns the shell command that sends signal to the
+// processes named killProcess. Where pkill is not installed the processes
+// are looked up in /proc instead, the command fails when none is found.
+func (c *Controller) killProcessCommand(signal string) string {
+	name := shellQuote(c.killProcess)
+	return fmt.Sprintf("if command -v pkill >/dev/null 2>&1; then pkill -%[1]s -x %[2]s; "+
+		"else rc=1; for p in /proc/[0-9]*; do "+
+		"if [ \"$(cat $p/comm 2>/dev/null)\" = %[2]s ]; then kill -s %[1]s ${p#/proc/} && rc=0; fi; "+
+		"done; exit $rc; fi", signal, name)
+}
+
+// truncateOutput trims whitespace off exec output and cuts it down to
+// maxOutputLength bytes
+func truncateOutput(output string) string {
+	output = strings.TrimSpace(output)
+	if len(output) > maxOutputLength {
+		return output[:maxOutputLength] + "...(truncated)"
+	}
+	return output
+}
+
+// shutdownResult is the outcome of the shutdown of a single sidecar
+type shutdownResult struct {
+	container string
+	err       error
+}
+
+// shutdownResults are the outcomes of the shutdown of the sidecars of a pod
+type shutdownResults []shutdownResult
+
+// set records the outcome for container, replacing an earlier one
+func (r *shutdownResults) set(container string, err error) {
+	for i := range *r {
+		if (*r)[i].container == container {
+			(*r)[i].err = err
 			return
 		}
+	}
+	*r = append(*r, shutdownResult{container: container, err: err})
+}
+
+// failed reports whether the shutdown of any sidecar failed
+func (r shutdownResults) failed() bool {
+	for _, result := range r {
+		if result.err != nil && !errors.Is(result.err, errContainerNotFound) {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the results as "istio-proxy (ok), vault-agent (failed: ...)"
+func (r shutdownResults) String() string {
+	parts := make([]string, 0, len(r))
+	for _, result := range r {
+		switch {
+		case result.err == nil:
+			parts = append(parts, result.container+" (ok)")
+		case errors.Is(result.err, errContainerNotFound):
+			parts = append(parts, result.container+" (not found)")
+		default:
+			parts = append(parts, fmt.Sprintf("%s (failed: %v)", result.container, result.err))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Send a shutdown signal to sidecar containers in the Pod. Containers listed
+// in the shutdown order are signaled one after the other, waiting for each to
+// terminate, before the remaining containers, which are signaled
+// concurrently. The outcome for every sidecar
+// is returned, along with the failures aggregated into an error. finishedAt
+// is the time the main containers finished, used to measure the shutdown
+// latency.
+func (c *Controller) sendShutdownSignal(ctx context.Context, pod *corev1.Pod, containers stringSet, finishedAt time.Time) (shutdownResults, error) {
+	logger := klog.FromContext(ctx)
+	if !finishedAt.IsZero() && !c.dryRun {
+		shutdownLatency.Observe(time.Since(finishedAt).Seconds())
+	}
+
+	// Protected containers are never signaled, whoever asks for it
+	containers = containers.Difference(c.protectedContainers)
+
+	var results shutdownResults
+	ordered, unordered := c.shutdownOrderFor(pod, containers)
+	for _, container := range ordered {
+		// Stop between containers when the controller is shutting down,
+		// the pod is not marked as signaled so whoever runs next picks it
+		// up again
+		if err := ctx.Err(); err != nil {
+			return results, fmt.Errorf("shutdown of pod interrupted: %w", err)
+		}
+		err := c.shutdownSidecar(ctx, pod, container)
+		results.set(container, err)
+		if errors.Is(err, errContainerNotFound) {
+			continue
+		} else if err != nil {
+			// The containers later in the order depend on this one, so
+			// they must not be signaled before it is gone
+			return results, fmt.Errorf("container %s: %w", container, err)
+		}
+		if c.dryRun {
+			continue
+		}
+		if err := c.escalate(ctx, pod, container); err != nil {
+			results.set(container, err)
+			return results, fmt.Errorf("container %s: %w", container, err)
+		}
+		logger.V(4).Info("Waiting for container to terminate", "pod", klog.KObj(pod), "container", container)
+		if err := c.waitForTermination(ctx, pod, container, terminationWaitTimeout); err != nil {
+			err = fmt.Errorf("error waiting for termination: %w", err)
+			results.set(container, err)
+			return results, fmt.Errorf("container %s: %w", container, err)
+		}
+	}
+
+	// The remaining sidecars do not depend on each other and are shut down
+	// concurrently, the exec slots bound the execs open at once
+	unorderedErrs := make([]error, len(unordered))
+	var wg sync.WaitGroup
+	for i, container := range unordered {
+		wg.Add(1)
+		go func(i int, container string) {
+			defer wg.Done()
+			err := c.shutdownSidecar(ctx, pod, container)
+			if err == nil && !c.dryRun {
+				err = c.escalate(ctx, pod, container)
+			}
+			unorderedErrs[i] = err
+		}(i, container)
+	}
+	wg.Wait()
+
+	var errs []error
+	for i, container := range unordered {
+		err := unorderedErrs[i]
+		results.set(container, err)
+		if err != nil && !errors.Is(err, errContainerNotFound) {
+			errs = append(errs, fmt.Errorf("container %s: %w", container, err))
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return results, fmt.Errorf("shutdown of pod interrupted: %w", err)
+	}
+	return results, utilerrors.NewAggregate(errs)
+}
+
+// resultAnnotation is the JSON value of the ResultAnnotation
+type resultAnnotation struct {
+	Time       string                `json:"time"`
+	Success    bool                  `json:"success"`
+	Containers []containerAnnotation `json:"containers"`
+}
+
+// containerAnnotation is the outcome for a single sidecar in the
+// ResultAnnotation, Result is "ok", "failed" or "not found"
+type containerAnnotation struct {
+	Name   string `json:"name"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
 
-		c.enqueuePod(pod)
+// annotateResults records the outcome of the shutdown of each sidecar in the
+// ResultAnnotation of the pod. Failures to annotate are only logged, the
+// Event already recorded the outcome.
+func (c *Controller) annotateResults(ctx context.Context, pod *corev1.Pod, results shutdownResults) {
+	if c.dryRun || len(results) == 0 {
+		return
+	}
+	annotation := resultAnnotation{
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Success: !results.failed(),
+	}
+	for _, result := range results {
+		container := containerAnnotation{Name: result.container, Result: "ok"}
+		switch {
+		case errors.Is(result.err, errContainerNotFound):
+			container.Result = "not found"
+		case result.err != nil:
+			container.Result = "failed"
+			container.Error = truncateOutput(result.err.Error())
+		}
+		annotation.Containers = append(annotation.Containers, container)
+	}
+	value, err := json.Marshal(annotation)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	// A merge patch leaves the other annotations alone, and without a
+	// resourceVersion it cannot conflict with other updates of the pod
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				ResultAnnotation: string(value),
+			},
+		},
+	})
+	if err != nil {
+		utilruntime.HandleError(err)
 		return
 	}
+	if _, err := c.kubeclientset.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		klog.FromContext(ctx).Error(err, "Error annotating pod with the shutdown results", "pod", klog.KObj(pod))
+	}
 }
 
-func (c *Controller) handleDeleteObject(obj interface{}) {
-	return
+// recordShutdownResults records a single Event on the pod with the outcome
+// of the shutdown of each of its sidecars
+func (c *Controller) recordShutdownResults(pod *corev1.Pod, results shutdownResults) {
+	if c.dryRun || len(results) == 0 {
+		return
+	}
+	if results.failed() {
+		c.recorder.Eventf(pod, corev1.EventTypeWarning, SidecarTerminationFailed, MessageSidecarTerminationFailed, results)
+		return
+	}
+	c.recorder.Eventf(pod, corev1.EventTypeNormal, SidecarTerminated, MessageSidecarTerminated, results)
 }
 
-// Send a shutdown signal to sidecar containers in the Pod
-func (c *Controller) sendShutdownSignal(ctx context.Context, pod *corev1.Pod, containers set.Set) {
+// verification tracks the checks that the signaled sidecars of a pod
+// terminated
+type verification struct {
+	containers stringSet
+	checks     int
+	// next is the time of the next check, syncs of the pod caused by
+	// updates before it do not count as a check
+	next time.Time
+}
+
+// startVerification schedules the first check that the sidecars that were
+// sent the shutdown command terminated
+func (c *Controller) startVerification(key string, pod *corev1.Pod, results shutdownResults) {
+	if c.verifyChecks == 0 || c.dryRun {
+		return
+	}
+	containers := newStringSet()
+	for _, result := range results {
+		if result.err == nil {
+			containers.Add(result.container)
+		}
+	}
+	if containers.Len() == 0 {
+		return
+	}
+	c.verifying.Add(pod.UID, &verification{
+		containers: containers,
+		next:       time.Now().Add(verifyTerminationInterval),
+	}, signaledCacheTTL)
+	c.workqueue.AddAfter(key, verifyTerminationInterval)
+}
 
-	// Multiple arguments must be provided as separate "command" parameters
-	// The first one is added automatically.
-	// Todo: Update requestFromConfig to handle this better
+// verifyTermination checks that the signaled sidecars of the pod terminated,
+// requeueing the pod until they did or the checks run out. Sidecars still
+// running after the last check are reported with an Event and sent the KILL
+// signal when escalation is enabled.
+func (c *Controller) verifyTermination(ctx context.Context, key string, pod *corev1.Pod, v *verification) {
 	logger := klog.FromContext(ctx)
-	config, err := clientcmd.BuildConfigFromFlags("", "")
+	if wait := time.Until(v.next); wait > 0 {
+		c.workqueue.AddAfter(key, wait)
+		return
+	}
+	running := newStringSet()
+	for container := range v.containers {
+		if !containerTerminated(pod, container) {
+			running.Add(container)
+		}
+	}
+	if running.Len() == 0 {
+		logger.V(4).Info("Sidecars terminated", "pod", pod.Name, "containers", v.containers)
+		c.verifying.Remove(pod.UID)
+		return
+	}
+	v.checks++
+	if v.checks < c.verifyChecks {
+		logger.V(4).Info("Sidecars still running, checking again", "pod", pod.Name, "containers", running,
+			"checks", v.checks)
+		v.next = time.Now().Add(verifyTerminationInterval)
+		c.workqueue.AddAfter(key, verifyTerminationInterval)
+		return
+	}
+
+	c.verifying.Remove(pod.UID)
+	logger.Info("Sidecars still running after the shutdown command", "pod", pod.Name, "containers", running,
+		"checks", v.checks)
+	c.recorder.Eventf(pod, corev1.EventTypeWarning, SidecarStillRunning, MessageSidecarStillRunning, running, v.checks)
+	if c.escalationGrace <= 0 {
+		return
+	}
+	var results shutdownResults
+	kill := c.killCommand("KILL")
+	for _, container := range running.ToSlice() {
+		err := c.ephemeralFallback(ctx, pod, container, kill, c.shutdownContainer(ctx, pod, container, kill))
+		results.set(container, err)
+	}
+	c.recordShutdownResults(pod, results)
+}
+
+// escalate waits up to the escalation grace period for a signaled container
+// to terminate and sends it the KILL signal if it is still running. It does
+// nothing when escalation is disabled.
+func (c *Controller) escalate(ctx context.Context, pod *corev1.Pod, container string) error {
+	if c.escalationGrace <= 0 {
+		return nil
+	}
+	err := c.waitForTermination(ctx, pod, container, c.escalationGrace)
+	if err == nil || !wait.Interrupted(err) || ctx.Err() != nil {
+		return err
+	}
+	klog.FromContext(ctx).Info("Sidecar still running after grace period, escalating", "pod", klog.KObj(pod),
+		"container", container, "grace", c.escalationGrace)
+	kill := c.killCommand("KILL")
+	err = c.ephemeralFallback(ctx, pod, container, kill, c.shutdownContainer(ctx, pod, container, kill))
+	if !errors.Is(err, errContainerNotFound) {
+		return err
+	}
+	return nil
+}
+
+// shutdownSidecar stops a single sidecar container. Sidecars with a shutdown
+// URL annotation are sent a POST request to that URL with curl, or wget when
+// curl is not installed, and sidecars with a signal annotation are sent that
+// signal. The others are streamed the shutdown script when one is configured
+// or sent the shutdown command otherwise.
+func (c *Controller) shutdownSidecar(ctx context.Context, pod *corev1.Pod, container string) error {
+	url, ok := pod.Annotations[ShutdownURLAnnotationPrefix+container]
+	if !ok {
+		if signal, ok := pod.Annotations[SignalAnnotationPrefix+container]; ok {
+			command := c.signalCommand(ctx, pod, container, signal)
+			return c.ephemeralFallback(ctx, pod, container, command, c.shutdownContainer(ctx, pod, container, command))
+		}
+		var err error
+		if c.shutdownScript != "" {
+			err = c.execShutdown(ctx, pod, container, []string{c.execShell, "-s"}, c.shutdownScript, c.shutdownScript)
+		} else {
+			err = c.shutdownContainer(ctx, pod, container, c.buildShutdownCommand())
+		}
+		return c.ephemeralFallback(ctx, pod, container, c.killCommand("TERM"), err)
+	}
+
+	err := c.shutdownContainer(ctx, pod, container, "curl -sf -X POST "+c.shellArg(url))
+	if commandNotFound(err) {
+		klog.FromContext(ctx).Info("curl not found in sidecar, retrying with wget", "pod", klog.KObj(pod), "container", container)
+		err = c.shutdownContainer(ctx, pod, container, "wget -q -O- --post-data="+c.shellArg("")+" "+c.shellArg(url))
+	}
+	return err
+}
+
+// commandNotFound reports whether the exec failed because the shell could
+// not find the command
+func commandNotFound(err error) bool {
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitStatus() == 127 {
+		return true
+	}
+	// Without a shell the container runtime reports the missing binary
+	return err != nil && strings.Contains(err.Error(), "executable file not found")
+}
+
+// containerNotFound reports whether err is the error of an exec into a
+// container that does not exist. The API server rejects execs into unknown
+// containers with a BadRequest status, while the kubelet reports containers
+// it cannot find in the runtime with a plain error message.
+func containerNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	if apierrors.IsNotFound(err) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "container not found") ||
+		(strings.Contains(msg, "container ") && strings.Contains(msg, " is not valid for pod "))
+}
+
+// shellArg quotes s for the exec shell, without a shell the command is split
+// on spaces and s is passed as is
+func (c *Controller) shellArg(s string) string {
+	if c.execShell == ExecShellNone {
+		return s
+	}
+	return shellQuote(s)
+}
+
+// shellQuote quotes s for use as a single word in a sh command line
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shutdownContainer runs the shutdown command in a single sidecar container
+func (c *Controller) shutdownContainer(ctx context.Context, pod *corev1.Pod, container, command string) error {
+	cmd := []string{c.execShell, "-c", command}
+	if c.execShell == ExecShellNone {
+		cmd = strings.Fields(command)
+	}
+	return c.execShutdown(ctx, pod, container, cmd, "", command)
+}
+
+// execShutdown runs cmd in a single sidecar container, streaming stdin to it
+// when it is not empty. command describes cmd in logs and Events.
+func (c *Controller) execShutdown(ctx context.Context, pod *corev1.Pod, container string, cmd []string, stdin, command string) error {
+	logger := klog.FromContext(ctx)
+
+	if c.dryRun {
+		logger.Info("Dry run, skipping exec into pod", "container", container, "command", command)
+		c.recorder.Eventf(pod, corev1.EventTypeNormal, DryRunShutdown, MessageDryRunShutdown, truncateOutput(command), container)
+		return nil
+	}
+
+	// Wait for a free exec slot so a burst of completing pods cannot open
+	// an unbounded number of streams to the API server
+	select {
+	case c.execSlots <- struct{}{}:
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for an exec slot: %w", ctx.Err())
+	}
+	defer func() { <-c.execSlots }()
+
+	logger.Info("Initiating exec into pod to kill main process", "container", container)
+
+	// Bound the exec so a hung connection cannot block the worker
+	execCtx, cancel := context.WithTimeout(ctx, c.execTimeout)
+	defer cancel()
+
+	start := time.Now()
+	// A fresh reader for every exec, the script is streamed again when the
+	// shutdown is retried
+	var stdinReader io.Reader
+	if stdin != "" {
+		stdinReader = strings.NewReader(stdin)
+	}
+	stdout, stderr, err := c.executor.Exec(execCtx, pod.Namespace, pod.Name, container, cmd, stdinReader)
+	execDuration.WithLabelValues(container).Observe(time.Since(start).Seconds())
+	logger.V(2).Info("Shutdown command output", "container", container,
+		"stdout", truncateOutput(stdout), "stderr", truncateOutput(stderr))
+
+	if containerNotFound(err) {
+		// The container restarted under a different name or was removed
+		// since the pod was enqueued, requeuing would only fail again
+		logger.Info("Sidecar not found, skipping its shutdown", "pod", klog.KObj(pod), "container", container, "err", err)
+		return fmt.Errorf("%w: %v", errContainerNotFound, err)
+	}
+	if apierrors.IsForbidden(err) {
+		if c.execForbidden.CompareAndSwap(false, true) {
+			logger.Error(err, "The controller is not allowed to exec into pods, no sidecar is shut down until "+
+				"its service account is granted create on pods/exec", "pod", klog.KObj(pod))
+		}
+	} else if err == nil && c.execForbidden.CompareAndSwap(true, false) {
+		logger.Info("The controller is allowed to exec into pods again")
+	}
 	if err != nil {
-        return
-	}
-	req := c.kubeclientset.CoreV1().RESTClient().Post().
-		Resource("pods").
-		Name(pod.Name).
-		Namespace(pod.Namespace).
-		SubResource("exec")
-
-	scheme := runtime.NewScheme()
-	if err := corev1.AddToScheme(scheme); err != nil {
-		logger.Info("There was an error adding to scheme", err)
-		return 
-	}
-	command := "kill -s TERM 1"
-	// creates the connection
-
-	for _, c := range containers.ToSlice() {
-		// Create a request out of config and the query parameters
-		parameterCodec := runtime.NewParameterCodec(scheme)
-		req.VersionedParams(&corev1.PodExecOptions{
-			Command:   []string{"sh", "-c", command},
-			Container: c.(string),
-			Stdin:     false,
-			Stdout:    true,
-			Stderr:    true,
-			TTY:       false,
-		}, parameterCodec)
-
-        logger.Info("Initiating exec into pod to kill main process")
-		exec, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
-		if err != nil {
-			logger.Info("There was an error executing", err)
+		shutdownAttempts.WithLabelValues(container, resultFailure).Inc()
+		if stderr = truncateOutput(stderr); stderr != "" {
+			return fmt.Errorf("%w: %s", err, stderr)
 		}
+		return err
+	}
+	shutdownAttempts.WithLabelValues(container, resultSuccess).Inc()
+	return nil
+}
 
-		var stdout, stderr bytes.Buffer
-		err = exec.Stream(remotecommand.StreamOptions{
-			Stdin:  nil,
-			Stdout: &stdout,
-			Stderr: &stderr,
-			Tty:    false,
+// signalCommand returns the command sending signal to the kill target of a
+// sidecar. Signals other than the shutdownSignals are replaced by TERM.
+func (c *Controller) signalCommand(ctx context.Context, pod *corev1.Pod, container, signal string) string {
+	name := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(signal)), "SIG")
+	if !shutdownSignals.Contains(name) {
+		klog.FromContext(ctx).Info("Unknown signal in annotation, sending TERM instead", "pod", klog.KObj(pod),
+			"container", container, "signal", signal)
+		name = "TERM"
+	}
+	return c.killCommand(name)
+}
+
+// primaryContainerFor returns the primary container of the pod, the
+// PrimaryContainerAnnotation taking precedence over the controller wide one
+func (c *Controller) primaryContainerFor(pod *corev1.Pod) string {
+	if primary, ok := pod.Annotations[PrimaryContainerAnnotation]; ok {
+		return strings.TrimSpace(primary)
+	}
+	return c.primaryContainer
+}
+
+// shutdownOrderFor splits the sidecars of the pod into those listed in the
+// shutdown order, in that order, and the remaining ones. The OrderAnnotation
+// takes precedence over the controller wide order.
+func (c *Controller) shutdownOrderFor(pod *corev1.Pod, containers stringSet) (ordered, unordered []string) {
+	order := c.shutdownOrder
+	if value, ok := pod.Annotations[OrderAnnotation]; ok {
+		order = strings.Split(value, ",")
+	}
+
+	listed := newStringSet()
+	for _, name := range order {
+		name = strings.TrimSpace(name)
+		if containers.Contains(name) && !listed.Contains(name) {
+			listed.Add(name)
+			ordered = append(ordered, name)
+		}
+	}
+	return ordered, containers.Difference(listed).ToSlice()
+}
+
+// waitForTermination polls the pod until the container has terminated or the
+// timeout expires
+func (c *Controller) waitForTermination(ctx context.Context, pod *corev1.Pod, container string, timeout time.Duration) error {
+	return wait.PollUntilContextTimeout(ctx, terminationPollInterval, timeout, true,
+		func(ctx context.Context) (bool, error) {
+			current, err := c.podsLister.Pods(pod.Namespace).Get(pod.Name)
+			if err != nil {
+				return false, err
+			}
+			return containerTerminated(current, container), nil
 		})
+}
 
-		if err != nil {
-			logger.Info("There was an error executing the stream", err)
+// containerTerminated reports whether the named container, regular or native
+// sidecar, of the pod is in a terminated state
+func containerTerminated(pod *corev1.Pod, container string) bool {
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.ContainerStatuses, pod.Status.InitContainerStatuses} {
+		for _, containerStatus := range statuses {
+			if containerStatus.Name == container {
+				return containerStatus.State.Terminated != nil
+			}
 		}
 	}
+	return false
 }
@@ -0,0 +1,703 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// fakeExec is a single call to the fakeExecutor
+type fakeExec struct {
+	namespace string
+	pod       string
+	container string
+	cmd       []string
+}
+
+// fakeExecutor records the execs instead of running them. Execs into the
+// containers in errs fail with that error.
+type fakeExecutor struct {
+	mu    sync.Mutex
+	execs []fakeExec
+	errs  map[string]error
+}
+
+// Exec implements Executor
+func (e *fakeExecutor) Exec(ctx context.Context, namespace, pod, container string, cmd []string, stdin io.Reader) (string, string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.execs = append(e.execs, fakeExec{namespace: namespace, pod: pod, container: container, cmd: cmd})
+	return "", "", e.errs[container]
+}
+
+// containers returns the containers exec'd into, sorted
+func (e *fakeExecutor) containers() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var containers []string
+	for _, exec := range e.execs {
+		containers = append(containers, exec.container)
+	}
+	sort.Strings(containers)
+	return containers
+}
+
+// fixture is a Controller backed by a fake clientset, with the pods fed to
+// its informer cache directly and the execs going to a fakeExecutor
+type fixture struct {
+	t          *testing.T
+	ctx        context.Context
+	client     *fake.Clientset
+	indexer    cache.Indexer
+	executor   *fakeExecutor
+	recorder   *record.FakeRecorder
+	controller *Controller
+}
+
+// newTestOptions returns the Options the controller runs with by default
+func newTestOptions() Options {
+	return Options{
+		Sidecars:               []string{"istio-proxy"},
+		SidecarMatchMode:       SidecarMatchExact,
+		ShutdownCommand:        DefaultShutdownCommand,
+		ShutdownStrategy:       ShutdownStrategySignal,
+		OwnerKinds:             []string{"Job"},
+		ExecTimeout:            time.Second,
+		PodPhases:              []string{string(corev1.PodRunning)},
+		MaxConcurrentExecs:     10,
+		RequeueBaseDelay:       time.Millisecond,
+		RequeueMaxDelay:        10 * time.Millisecond,
+		ExecShell:              ExecShellSh,
+		TerminateOnMainFailure: true,
+		RunningDetection:       RunningDetectionReady,
+		AccountingMode:         AccountingStrict,
+		SidecarMatchBy:         SidecarMatchByName,
+	}
+}
+
+// newFixture builds a Controller with opts whose informer cache and fake
+// clientset hold pods
+func newFixture(t *testing.T, opts Options, pods ...*corev1.Pod) *fixture {
+	t.Helper()
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("invalid options: %v", err)
+	}
+	f := &fixture{
+		t:        t,
+		ctx:      context.Background(),
+		executor: &fakeExecutor{errs: map[string]error{}},
+		recorder: record.NewFakeRecorder(100),
+	}
+	objects := make([]runtime.Object, 0, len(pods))
+	for _, pod := range pods {
+		objects = append(objects, pod)
+	}
+	f.client = fake.NewSimpleClientset(objects...)
+	factory := kubeinformers.NewSharedInformerFactory(f.client, 0)
+	podInformer := factory.Core().V1().Pods()
+
+	opts.Executor = f.executor
+	controller, err := NewController(f.ctx, f.client, &rest.Config{}, podInformer, opts)
+	if err != nil {
+		t.Fatalf("error creating controller: %v", err)
+	}
+	controller.recorder = f.recorder
+	t.Cleanup(controller.workqueue.ShutDown)
+	f.controller = controller
+
+	f.indexer = podInformer.Informer().GetIndexer()
+	for _, pod := range pods {
+		if err := f.indexer.Add(pod); err != nil {
+			t.Fatalf("error adding pod to the informer cache: %v", err)
+		}
+	}
+	return f
+}
+
+// sync runs the syncHandler of the controller for the pod
+func (f *fixture) sync(pod *corev1.Pod) error {
+	f.t.Helper()
+	return f.controller.syncHandler(f.ctx, podKey(pod))
+}
+
+// process queues the pod and processes it like a worker does
+func (f *fixture) process(pod *corev1.Pod) {
+	f.t.Helper()
+	f.controller.workqueue.Add(podKey(pod))
+	f.controller.processNextWorkItem(f.ctx)
+}
+
+// events drains the Events recorded so far
+func (f *fixture) events() []string {
+	var events []string
+	for {
+		select {
+		case event := <-f.recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// podKey returns the workqueue key of the pod
+func podKey(pod *corev1.Pod) string {
+	return pod.Namespace + "/" + pod.Name
+}
+
+// newJobPod returns a running pod controlled by a Job, with a container for
+// every status
+func newJobPod(name string, statuses ...corev1.ContainerStatus) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: metav1.NamespaceDefault,
+			UID:       types.UID(name + "-uid"),
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "job", UID: "job-uid"}},
+					batchv1.SchemeGroupVersion.WithKind("Job")),
+			},
+		},
+		Spec: corev1.PodSpec{RestartPolicy: corev1.RestartPolicyNever},
+		Status: corev1.PodStatus{
+			Phase:             corev1.PodRunning,
+			ContainerStatuses: statuses,
+		},
+	}
+	for _, status := range statuses {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: status.Name, Image: status.Name + ":latest"})
+	}
+	return pod
+}
+
+// running returns the status of a Ready running container
+func running(name string) corev1.ContainerStatus {
+	return corev1.ContainerStatus{
+		Name:  name,
+		Ready: true,
+		State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+	}
+}
+
+// terminated returns the status of a container terminated with reason and
+// exitCode
+func terminated(name, reason string, exitCode int32) corev1.ContainerStatus {
+	return corev1.ContainerStatus{
+		Name: name,
+		State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+			Reason:     reason,
+			ExitCode:   exitCode,
+			FinishedAt: metav1.NewTime(time.Now().Add(-time.Minute)),
+		}},
+	}
+}
+
+// waiting returns the status of a container waiting for reason
+func waiting(name, reason string) corev1.ContainerStatus {
+	return corev1.ContainerStatus{
+		Name:  name,
+		State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason}},
+	}
+}
+
+func TestSyncHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		want []string
+	}{
+		{
+			name: "only sidecar running",
+			pod:  newJobPod("done", terminated("app", "Completed", 0), running("istio-proxy")),
+			want: []string{"istio-proxy"},
+		},
+		{
+			name: "main container running",
+			pod:  newJobPod("busy", running("app"), running("istio-proxy")),
+		},
+		{
+			name: "main container waiting",
+			pod:  newJobPod("starting", waiting("app", "ContainerCreating"), running("istio-proxy")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, newTestOptions(), tt.pod)
+			if err := f.sync(tt.pod); err != nil {
+				t.Fatalf("syncHandler() error = %v", err)
+			}
+			if got := f.executor.containers(); !equalStrings(got, tt.want) {
+				t.Errorf("exec'd into %v, want %v", got, tt.want)
+			}
+			_, signaled := f.controller.signaled.Get(tt.pod.UID)
+			if signaled != (len(tt.want) > 0) {
+				t.Errorf("pod signaled = %v, want %v", signaled, len(tt.want) > 0)
+			}
+		})
+	}
+}
+
+func TestSyncHandlerSignalsOnce(t *testing.T) {
+	pod := newJobPod("done", terminated("app", "Completed", 0), running("istio-proxy"))
+	f := newFixture(t, newTestOptions(), pod)
+	for i := 0; i < 2; i++ {
+		if err := f.sync(pod); err != nil {
+			t.Fatalf("syncHandler() error = %v", err)
+		}
+	}
+	if got := f.executor.containers(); len(got) != 1 {
+		t.Errorf("exec'd into %v, want a single exec", got)
+	}
+}
+
+func TestHandleObjectOwner(t *testing.T) {
+	owned := newJobPod("owned", terminated("app", "Completed", 0), running("istio-proxy"))
+	bare := newJobPod("bare", terminated("app", "Completed", 0), running("istio-proxy"))
+	bare.OwnerReferences = nil
+	replicaSet := newJobPod("replicaset", terminated("app", "Completed", 0), running("istio-proxy"))
+	replicaSet.OwnerReferences[0].Kind = "ReplicaSet"
+
+	tests := []struct {
+		pod  *corev1.Pod
+		want int
+	}{
+		{pod: owned, want: 1},
+		{pod: bare, want: 0},
+		{pod: replicaSet, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pod.Name, func(t *testing.T) {
+			f := newFixture(t, newTestOptions(), tt.pod)
+			f.controller.handleObject(tt.pod)
+			if got := f.controller.workqueue.Len(); got != tt.want {
+				t.Errorf("queue length = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleObjectForced(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        int
+	}{
+		{name: "forced", annotations: map[string]string{ForceAnnotation: "true"}, want: 1},
+		{name: "not forced", want: 0},
+		{name: "forced false", annotations: map[string]string{ForceAnnotation: "false"}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newJobPod("bare", terminated("app", "Completed", 0), running("istio-proxy"))
+			pod.OwnerReferences = nil
+			pod.Annotations = tt.annotations
+			f := newFixture(t, newTestOptions(), pod)
+			f.controller.handleObject(pod)
+			if got := f.controller.workqueue.Len(); got != tt.want {
+				t.Errorf("queue length = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleObjectNotOwnedCounted(t *testing.T) {
+	bare := newJobPod("bare", terminated("app", "Completed", 0), running("istio-proxy"))
+	bare.OwnerReferences = nil
+	f := newFixture(t, newTestOptions(), bare)
+	skipped := podsSkipped.WithLabelValues(skipNotOwned)
+
+	before := testutil.ToFloat64(skipped)
+	f.controller.handleObject(bare)
+	if got := testutil.ToFloat64(skipped) - before; got != 1 {
+		t.Errorf("%s skips counted on an update = %v, want 1", skipNotOwned, got)
+	}
+	before = testutil.ToFloat64(skipped)
+	f.controller.handlePod(bare, true)
+	if got := testutil.ToFloat64(skipped) - before; got != 0 {
+		t.Errorf("%s skips counted on a resync = %v, want 0", skipNotOwned, got)
+	}
+}
+
+func TestHandleObjectOptIn(t *testing.T) {
+	tests := []struct {
+		name         string
+		requireOptIn bool
+		annotations  map[string]string
+		want         int
+	}{
+		{name: "opt-in enabled", requireOptIn: true, annotations: map[string]string{EnabledAnnotation: "true"}, want: 1},
+		{name: "opt-in not enabled", requireOptIn: true, annotations: map[string]string{EnabledAnnotation: "false"}, want: 0},
+		{name: "opt-in missing", requireOptIn: true, want: 0},
+		{name: "no opt-in enabled", annotations: map[string]string{EnabledAnnotation: "true"}, want: 1},
+		{name: "no opt-in missing", want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newJobPod("pod", terminated("app", "Completed", 0), running("istio-proxy"))
+			pod.Annotations = tt.annotations
+			opts := newTestOptions()
+			opts.RequireOptIn = tt.requireOptIn
+			f := newFixture(t, opts, pod)
+			f.controller.handleObject(pod)
+			if got := f.controller.workqueue.Len(); got != tt.want {
+				t.Errorf("queue length = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleObjectDisabled(t *testing.T) {
+	tests := []struct {
+		name         string
+		requireOptIn bool
+		annotations  map[string]string
+		want         int
+	}{
+		{name: "disabled", annotations: map[string]string{DisabledAnnotation: "true"}, want: 0},
+		{name: "disabled and opted in", requireOptIn: true, annotations: map[string]string{EnabledAnnotation: "true", DisabledAnnotation: "true"}, want: 0},
+		{name: "not disabled", annotations: map[string]string{DisabledAnnotation: "false"}, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newJobPod("pod", terminated("app", "Completed", 0), running("istio-proxy"))
+			pod.Annotations = tt.annotations
+			opts := newTestOptions()
+			opts.RequireOptIn = tt.requireOptIn
+			f := newFixture(t, opts, pod)
+			f.controller.handleObject(pod)
+			if got := f.controller.workqueue.Len(); got != tt.want {
+				t.Errorf("queue length = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessNextWorkItemRequeuesFailedExec(t *testing.T) {
+	pod := newJobPod("done", terminated("app", "Completed", 0), running("istio-proxy"))
+	f := newFixture(t, newTestOptions(), pod)
+	f.executor.errs["istio-proxy"] = errors.New("connection reset by peer")
+
+	f.process(pod)
+	if got := f.controller.workqueue.NumRequeues(podKey(pod)); got != 1 {
+		t.Errorf("NumRequeues() = %d, want 1", got)
+	}
+	if _, signaled := f.controller.signaled.Get(pod.UID); signaled {
+		t.Error("pod marked as signaled after a failed exec")
+	}
+
+	// The shutdown succeeds once the exec does
+	delete(f.executor.errs, "istio-proxy")
+	f.controller.processNextWorkItem(f.ctx)
+	if got := f.controller.workqueue.NumRequeues(podKey(pod)); got != 0 {
+		t.Errorf("NumRequeues() = %d after a successful retry, want 0", got)
+	}
+	if got := f.executor.containers(); len(got) != 2 {
+		t.Errorf("exec'd into %v, want two execs", got)
+	}
+}
+
+func TestSyncHandlerAggregatesExecErrors(t *testing.T) {
+	pod := newJobPod("done", terminated("app", "Completed", 0), running("istio-proxy"), running("vault-agent"))
+	opts := newTestOptions()
+	opts.Sidecars = []string{"istio-proxy", "vault-agent"}
+	f := newFixture(t, opts, pod)
+	f.executor.errs["istio-proxy"] = errors.New("connection reset by peer")
+
+	err := f.sync(pod)
+	if err == nil || !strings.Contains(err.Error(), "container istio-proxy") {
+		t.Fatalf("syncHandler() error = %v, want the failure of istio-proxy", err)
+	}
+	// The failing sidecar does not keep the other from being signaled
+	if got, want := f.executor.containers(), []string{"istio-proxy", "vault-agent"}; !equalStrings(got, want) {
+		t.Errorf("exec'd into %v, want %v", got, want)
+	}
+
+	f.process(pod)
+	if got := f.controller.workqueue.NumRequeues(podKey(pod)); got != 1 {
+		t.Errorf("NumRequeues() = %d, want 1", got)
+	}
+}
+
+func TestSyncHandlerDryRun(t *testing.T) {
+	pod := newJobPod("done", terminated("app", "Completed", 0), running("istio-proxy"))
+	opts := newTestOptions()
+	opts.DryRun = true
+	f := newFixture(t, opts, pod)
+
+	if err := f.sync(pod); err != nil {
+		t.Fatalf("syncHandler() error = %v", err)
+	}
+	if got := f.executor.containers(); len(got) != 0 {
+		t.Errorf("exec'd into %v in dry-run mode", got)
+	}
+	var dryRuns int
+	for _, event := range f.events() {
+		if strings.HasPrefix(event, "Normal "+DryRunShutdown) {
+			dryRuns++
+		}
+	}
+	if dryRuns != 1 {
+		t.Errorf("%d %s Events recorded, want 1", dryRuns, DryRunShutdown)
+	}
+	for _, action := range f.client.Actions() {
+		if action.GetVerb() == "patch" {
+			t.Errorf("pod patched in dry-run mode: %v", action)
+		}
+	}
+}
+
+func TestSyncHandlerNativeSidecar(t *testing.T) {
+	always := corev1.ContainerRestartPolicyAlways
+	pod := newJobPod("native", terminated("app", "Completed", 0))
+	pod.Spec.InitContainers = []corev1.Container{
+		{Name: "setup"},
+		{Name: "log-shipper", RestartPolicy: &always},
+	}
+	pod.Status.InitContainerStatuses = []corev1.ContainerStatus{
+		terminated("setup", "Completed", 0),
+		running("log-shipper"),
+	}
+	f := newFixture(t, newTestOptions(), pod)
+
+	if err := f.sync(pod); err != nil {
+		t.Fatalf("syncHandler() error = %v", err)
+	}
+	if got, want := f.executor.containers(), []string{"log-shipper"}; !equalStrings(got, want) {
+		t.Errorf("exec'd into %v, want %v", got, want)
+	}
+}
+
+func TestProcessNextWorkItemGivesUp(t *testing.T) {
+	pod := newJobPod("done", terminated("app", "Completed", 0), running("istio-proxy"))
+	opts := newTestOptions()
+	opts.MaxRetries = 5
+	f := newFixture(t, opts, pod)
+	f.executor.errs["istio-proxy"] = errors.New("connection reset by peer")
+
+	f.process(pod)
+	for i := 1; i <= opts.MaxRetries; i++ {
+		if got := f.controller.workqueue.NumRequeues(podKey(pod)); got != i {
+			t.Fatalf("NumRequeues() = %d after %d failures, want %d", got, i, i)
+		}
+		// Blocks until the rate limited item is back in the queue
+		f.controller.processNextWorkItem(f.ctx)
+	}
+
+	// The 6th failure drops the item
+	if got := f.controller.workqueue.NumRequeues(podKey(pod)); got != 0 {
+		t.Errorf("NumRequeues() = %d after giving up, want 0", got)
+	}
+	time.Sleep(2 * opts.RequeueMaxDelay)
+	if got := f.controller.workqueue.Len(); got != 0 {
+		t.Errorf("queue length = %d after giving up, want 0", got)
+	}
+	events := f.events()
+	if len(events) == 0 || !strings.HasPrefix(events[len(events)-1], "Warning "+MaxRetriesExceeded) {
+		t.Errorf("events = %v, want a final %s Event", events, MaxRetriesExceeded)
+	}
+}
+
+func TestDeletingPodSkipped(t *testing.T) {
+	pod := newJobPod("deleting", terminated("app", "Completed", 0), running("istio-proxy"))
+	now := metav1.Now()
+	pod.DeletionTimestamp = &now
+	f := newFixture(t, newTestOptions(), pod)
+
+	f.controller.handleObject(pod)
+	if got := f.controller.workqueue.Len(); got != 0 {
+		t.Errorf("queue length = %d, want 0", got)
+	}
+	// A pod queued before its deletion started is not exec'd into either
+	if err := f.sync(pod); err != nil {
+		t.Fatalf("syncHandler() error = %v", err)
+	}
+	if got := f.executor.containers(); len(got) != 0 {
+		t.Errorf("exec'd into %v of a pod being deleted", got)
+	}
+}
+
+func TestHandleDeleteObject(t *testing.T) {
+	tests := []struct {
+		name   string
+		delete func(pod *corev1.Pod) interface{}
+	}{
+		{name: "pod", delete: func(pod *corev1.Pod) interface{} { return pod }},
+		{
+			name: "tombstone",
+			delete: func(pod *corev1.Pod) interface{} {
+				return cache.DeletedFinalStateUnknown{Key: podKey(pod), Obj: pod}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newJobPod("done", terminated("app", "Completed", 0), running("istio-proxy"))
+			f := newFixture(t, newTestOptions(), pod)
+			f.executor.errs["istio-proxy"] = errors.New("connection reset by peer")
+			f.process(pod)
+			delete(f.executor.errs, "istio-proxy")
+			if err := f.sync(pod); err != nil {
+				t.Fatalf("syncHandler() error = %v", err)
+			}
+			if _, signaled := f.controller.signaled.Get(pod.UID); !signaled {
+				t.Fatal("pod not marked as signaled")
+			}
+			// No pre-shutdown webhook is configured, record a veto by hand
+			f.controller.vetoed.Add(pod.UID, struct{}{}, signaledCacheTTL)
+
+			f.controller.handleDeleteObject(tt.delete(pod))
+			caches := map[string]*utilcache.LRUExpireCache{
+				"signaled":   f.controller.signaled,
+				"abandoned":  f.controller.abandoned,
+				"verifying":  f.controller.verifying,
+				"mismatched": f.controller.mismatched,
+				"rechecks":   f.controller.rechecks,
+				"vetoed":     f.controller.vetoed,
+			}
+			for name, c := range caches {
+				if keys := c.Keys(); len(keys) != 0 {
+					t.Errorf("%s cache holds %v after the pod was deleted", name, keys)
+				}
+			}
+			if got := f.controller.workqueue.NumRequeues(podKey(pod)); got != 0 {
+				t.Errorf("NumRequeues() = %d after the pod was deleted, want 0", got)
+			}
+		})
+	}
+}
+
+func TestPermanentError(t *testing.T) {
+	pods := corev1.Resource("pods")
+	forbidden := apierrors.NewForbidden(pods, "job-pod", errors.New("cannot create pods/exec"))
+	timeout := apierrors.NewTimeoutError("exec timed out", 1)
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "forbidden", err: forbidden, want: true},
+		{name: "unauthorized", err: apierrors.NewUnauthorized("invalid token"), want: true},
+		{name: "not found", err: apierrors.NewNotFound(pods, "job-pod"), want: true},
+		{name: "bad request", err: apierrors.NewBadRequest("container not valid"), want: true},
+		{name: "wrapped forbidden", err: fmt.Errorf("container istio-proxy: %w", forbidden), want: true},
+		{name: "timeout", err: timeout},
+		{name: "server timeout", err: apierrors.NewServerTimeout(pods, "create", 1)},
+		{name: "internal error", err: apierrors.NewInternalError(errors.New("etcd unavailable"))},
+		{name: "service unavailable", err: apierrors.NewServiceUnavailable("apiserver restarting")},
+		{name: "too many requests", err: apierrors.NewTooManyRequests("slow down", 1)},
+		{name: "not an API error", err: errors.New("connection reset by peer")},
+		{name: "all permanent", err: utilerrors.NewAggregate([]error{forbidden, forbidden}), want: true},
+		{name: "some transient", err: utilerrors.NewAggregate([]error{forbidden, timeout})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := permanentError(tt.err); got != tt.want {
+				t.Errorf("permanentError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessNextWorkItemMissingPod(t *testing.T) {
+	pod := newJobPod("gone", terminated("app", "Completed", 0), running("istio-proxy"))
+	f := newFixture(t, newTestOptions())
+
+	f.process(pod)
+	if got := f.controller.workqueue.NumRequeues(podKey(pod)); got != 0 {
+		t.Errorf("NumRequeues() = %d, want 0", got)
+	}
+	time.Sleep(2 * newTestOptions().RequeueMaxDelay)
+	if got := f.controller.workqueue.Len(); got != 0 {
+		t.Errorf("queue length = %d, want 0", got)
+	}
+	if got := f.executor.containers(); len(got) != 0 {
+		t.Errorf("exec'd into %v of a missing pod", got)
+	}
+}
+
+func TestSyncHandlerIndexedJob(t *testing.T) {
+	var pods []*corev1.Pod
+	for _, index := range []string{"0", "1"} {
+		pod := newJobPod("indexed-"+index, terminated("app", "Completed", 0), running("istio-proxy"))
+		pod.Annotations = map[string]string{batchv1.JobCompletionIndexAnnotation: index}
+		pod.Labels = map[string]string{batchv1.JobCompletionIndexAnnotation: index}
+		pods = append(pods, pod)
+	}
+	f := newFixture(t, newTestOptions(), pods...)
+
+	for _, pod := range pods {
+		f.controller.handleObject(pod)
+	}
+	if got := f.controller.workqueue.Len(); got != len(pods) {
+		t.Fatalf("queue length = %d, want %d", got, len(pods))
+	}
+	for range pods {
+		f.controller.processNextWorkItem(f.ctx)
+	}
+	for _, pod := range pods {
+		if _, signaled := f.controller.signaled.Get(pod.UID); !signaled {
+			t.Errorf("pod %s not signaled", pod.Name)
+		}
+	}
+	if got, want := f.executor.containers(), []string{"istio-proxy", "istio-proxy"}; !equalStrings(got, want) {
+		t.Errorf("exec'd into %v, want %v", got, want)
+	}
+}
+
+func TestRateLimiterJitter(t *testing.T) {
+	baseDelay, maxDelay := 100*time.Millisecond, time.Second
+	delays := []time.Duration{baseDelay, 2 * baseDelay, 4 * baseDelay, 8 * baseDelay, maxDelay, maxDelay}
+	for _, jitter := range []float64{0, 0.5} {
+		t.Run(fmt.Sprint(jitter), func(t *testing.T) {
+			limiter := newRateLimiter(baseDelay, maxDelay, jitter)
+			for i, want := range delays {
+				max := time.Duration(float64(want) * (1 + jitter))
+				if max > maxDelay {
+					max = maxDelay
+				}
+				if got := limiter.When("default/pod"); got < want || got > max {
+					t.Errorf("delay of retry %d = %s, want between %s and %s", i+1, got, want, max)
+				}
+			}
+			limiter.Forget("default/pod")
+			if got := limiter.NumRequeues("default/pod"); got != 0 {
+				t.Errorf("NumRequeues() = %d after Forget, want 0", got)
+			}
+		})
+	}
+}
+
+// equalStrings reports whether a and b hold the same strings in the same
+// order, nil and empty being equal
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
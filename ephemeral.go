@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/klog/v2"
+)
+
+// DefaultEphemeralImage is the image of the ephemeral containers sending the
+// shutdown signal to sidecars without a shell or kill binary
+const DefaultEphemeralImage = "busybox:1.36"
+
+// ephemeralFallback shuts the sidecar down from an ephemeral container
+// running command when err says the exec into the sidecar failed because it
+// has no shell or binary to run the shutdown command with. Any other err is
+// returned as is.
+func (c *Controller) ephemeralFallback(ctx context.Context, pod *corev1.Pod, container, command string, err error) error {
+	if !c.allowEphemeralFallback || !commandNotFound(err) {
+		return err
+	}
+	klog.FromContext(ctx).Info("Shutdown command not found in sidecar, signaling it from an ephemeral container",
+		"pod", klog.KObj(pod), "container", container, "err", err)
+	return c.shutdownFromEphemeralContainer(ctx, pod, container, command)
+}
+
+// shutdownFromEphemeralContainer adds an ephemeral container to the pod that
+// runs command in the process namespace of the sidecar, where PID 1 is the
+// sidecar's main process. Ephemeral containers cannot be removed, the
+// container stays in the pod spec after it exited.
+func (c *Controller) shutdownFromEphemeralContainer(ctx context.Context, pod *corev1.Pod, container, command string) error {
+	// With a shared process namespace PID 1 is the pause container, whose
+	// exit would take the whole pod down
+	if pod.Spec.ShareProcessNamespace != nil && *pod.Spec.ShareProcessNamespace &&
+		c.killProcess == "" && c.discoverPattern == "" {
+		return fmt.Errorf("not signaling PID 1 from an ephemeral container in a pod sharing its process namespace")
+	}
+
+	// Container names are DNS labels of at most 63 characters
+	prefix := container
+	if len(prefix) > 40 {
+		prefix = prefix[:40]
+	}
+	name := fmt.Sprintf("terminate-%s-%s", prefix, utilrand.String(5))
+
+	updated := pod.DeepCopy()
+	updated.Spec.EphemeralContainers = append(updated.Spec.EphemeralContainers, corev1.EphemeralContainer{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+			Name:            name,
+			Image:           c.ephemeralImage,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Command:         []string{"sh", "-c", command},
+		},
+		TargetContainerName: container,
+	})
+	_, err := c.kubeclientset.CoreV1().Pods(pod.Namespace).UpdateEphemeralContainers(ctx, pod.Name, updated, metav1.UpdateOptions{})
+	if err != nil {
+		shutdownAttempts.WithLabelValues(container, resultFailure).Inc()
+		return fmt.Errorf("error adding ephemeral container: %w", err)
+	}
+	klog.FromContext(ctx).Info("Added ephemeral container to signal sidecar", "pod", klog.KObj(pod),
+		"container", container, "ephemeralContainer", name)
+	shutdownAttempts.WithLabelValues(container, resultSuccess).Inc()
+	return nil
+}
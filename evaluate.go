@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ContainerState is the part a container plays in deciding whether the
+// sidecars of its pod are shut down
+type ContainerState int
+
+const (
+	// ContainerPending containers have not started yet, the pod is
+	// evaluated again once they have
+	ContainerPending ContainerState = iota
+	// ContainerRunning containers are up and running
+	ContainerRunning
+	// ContainerCompleted containers have finished
+	ContainerCompleted
+	// ContainerFailed containers have finished unsuccessfully
+	ContainerFailed
+	// ContainerBlocked containers are waiting for a reason that is unlikely
+	// to resolve by itself, such as an image that cannot be pulled
+	ContainerBlocked
+	// ContainerOther containers are neither running nor completed, e.g.
+	// terminated for a reason that is not accounted for
+	ContainerOther
+	// ContainerRestarting containers have terminated but are restarted by
+	// the kubelet, as the restart policy of the pod asks for
+	ContainerRestarting
+)
+
+// ContainerClassifier decides the state of a container from its status.
+// sidecar tells whether the container is one of the sidecars of its pod.
+type ContainerClassifier interface {
+	Classify(status corev1.ContainerStatus, sidecar bool) ContainerState
+}
+
+// DefaultCompletedReasons are the termination reasons of the containers the
+// default classifier counts as completed unless told otherwise
+var DefaultCompletedReasons = []string{"Completed", "Error"}
+
+// defaultClassifier treats Ready containers as running and containers
+// terminated with one of the completedReasons as completed, those
+// terminated with any other reason than Completed failing unless they are
+// sidecars. With successExitCodes set the exit code decides instead of the
+// reason, and every reason counts when completedReasons is empty. With
+// runningByState set containers in the Running state count as running
+// whether they are Ready or not, with sidecarRunningByState only sidecars do.
+type defaultClassifier struct {
+	completedReasons      stringSet
+	successExitCodes      map[int32]bool
+	runningByState        bool
+	sidecarRunningByState bool
+}
+
+// NewDefaultContainerClassifier returns the ContainerClassifier the
+// controller uses unless Options.ContainerClassifier is set. Main containers
+// exiting with one of successExitCodes count as successful whatever their
+// termination reason. Containers terminated with one of completedReasons are
+// accounted for as completed. When completedReasons is empty every reason is
+// with successExitCodes, and the DefaultCompletedReasons are without.
+// runningDetection is RunningDetectionReady, RunningDetectionState or
+// RunningDetectionSidecarState.
+func NewDefaultContainerClassifier(successExitCodes []int32, completedReasons []string, runningDetection string) ContainerClassifier {
+	reasons := newSetFromSlice(completedReasons)
+	if reasons.Len() == 0 && len(successExitCodes) == 0 {
+		reasons = newSetFromSlice(DefaultCompletedReasons)
+	}
+	c := defaultClassifier{
+		completedReasons:      reasons,
+		successExitCodes:      make(map[int32]bool, len(successExitCodes)),
+		runningByState:        runningDetection == RunningDetectionState,
+		sidecarRunningByState: runningDetection == RunningDetectionSidecarState,
+	}
+	for _, code := range successExitCodes {
+		c.successExitCodes[code] = true
+	}
+	return c
+}
+
+// Classify implements ContainerClassifier
+func (c defaultClassifier) Classify(status corev1.ContainerStatus, sidecar bool) ContainerState {
+	byState := c.runningByState || (sidecar && c.sidecarRunningByState)
+	if status.Ready || (byState && status.State.Running != nil) {
+		return ContainerRunning
+	}
+	terminated := status.State.Terminated
+	waiting := status.State.Waiting
+	switch {
+	case terminated != nil && c.completedReasons.Len() > 0 && !c.completedReasons.Contains(terminated.Reason):
+		// Not accounted for, whatever the exit code
+		return ContainerOther
+	case terminated != nil && len(c.successExitCodes) > 0:
+		// The exit code alone decides whether it succeeded
+		if !c.successExitCodes[terminated.ExitCode] && !sidecar {
+			return ContainerFailed
+		}
+		return ContainerCompleted
+	case terminated != nil:
+		if terminated.Reason != "Completed" && !sidecar {
+			return ContainerFailed
+		}
+		return ContainerCompleted
+	case waiting != nil && blockedWaitingReasons.Contains(waiting.Reason):
+		return ContainerBlocked
+	case terminated == nil:
+		// Still starting up, or no state reported yet
+		return ContainerPending
+	default:
+		return ContainerOther
+	}
+}
+
+// podEvaluation is the outcome of evaluatePod
+type podEvaluation struct {
+	// all, running and completed are the containers taking part in the
+	// accounting, and those of them running and completed
+	all       stringSet
+	running   stringSet
+	completed stringSet
+	// targets are the running sidecars to shut down
+	targets stringSet
+	// finishedAt is when the last main container, or the primary
+	// container, finished
+	finishedAt time.Time
+	// skipReason explains why the sidecars are not shut down, it is empty
+	// when the running sidecars are to be shut down
+	skipReason string
+}
+
+// shouldShutdown reports whether the running sidecars are to be shut down
+func (e podEvaluation) shouldShutdown() bool {
+	return e.skipReason == ""
+}
+
+// evaluatePod decides whether the running containers of the pod, all of
+// them sidecars, are to be shut down. When the pod has a primary container
+// the running sidecars are shut down as soon as it completed instead.
+// Protected containers are accounted for like sidecars but never shut down.
+func (c *Controller) evaluatePod(pod *corev1.Pod, sidecars stringSet) podEvaluation {
+	sidecars = sidecars.Union(c.protectedContainers)
+	eval := podEvaluation{
+		all:       newStringSet(),
+		running:   newStringSet(),
+		completed: newStringSet(),
+	}
+	failed := newStringSet()
+	// pending containers have not started yet and will be evaluated on a
+	// later update, blocked ones are waiting for a reason that is unlikely
+	// to resolve by itself
+	pending := newStringSet()
+	blocked := newStringSet()
+	// restarting containers terminated in between two runs, they have not
+	// truly completed
+	restarting := newStringSet()
+
+	// Native sidecars report their status with the init containers, the
+	// other init containers have finished before the regular containers
+	// started and are left out
+	native := nativeSidecars(pod)
+	statuses := append([]corev1.ContainerStatus{}, pod.Status.ContainerStatuses...)
+	for _, containerStatus := range pod.Status.InitContainerStatuses {
+		if native.Contains(containerStatus.Name) {
+			statuses = append(statuses, containerStatus)
+		}
+	}
+
+	primary := c.primaryContainerFor(pod)
+	var primaryStatus *corev1.ContainerStatus
+	var primaryState ContainerState
+	for i, containerStatus := range statuses {
+		// Ignored containers do not take part in the accounting at all
+		if c.ignoreContainers.Contains(containerStatus.Name) {
+			continue
+		}
+		eval.all.Add(containerStatus.Name)
+
+		state := c.classifier.Classify(containerStatus, sidecars.Contains(containerStatus.Name))
+		if state != ContainerRunning && willRestart(pod, containerStatus, native.Contains(containerStatus.Name)) {
+			state = ContainerRestarting
+		}
+		if containerStatus.Name == primary && !sidecars.Contains(primary) {
+			primaryStatus, primaryState = &statuses[i], state
+		}
+		switch state {
+		case ContainerRunning:
+			eval.running.Add(containerStatus.Name)
+		case ContainerFailed:
+			failed.Add(containerStatus.Name)
+			eval.completed.Add(containerStatus.Name)
+		case ContainerCompleted:
+			eval.completed.Add(containerStatus.Name)
+		case ContainerBlocked:
+			blocked.Add(containerStatus.Name)
+		case ContainerPending:
+			pending.Add(containerStatus.Name)
+		case ContainerRestarting:
+			restarting.Add(containerStatus.Name)
+		}
+	}
+	if primaryStatus != nil {
+		return c.protect(c.evaluatePrimary(eval, sidecars, primaryStatus, primaryState))
+	}
+	eval.targets = eval.running
+	eval.finishedAt = lastFinishedAt(statuses, sidecars)
+	if c.accountingMode == AccountingLenient {
+		return c.protect(c.evaluateLenient(eval, sidecars, failed))
+	}
+
+	// If we have accounted for all of the containers, and sidecar containers are the only
+	// ones still running, issue each running sidecar a shutdown command
+	if blocked.Len() > 0 {
+		eval.skipReason = fmt.Sprintf("containers %s are blocked waiting and may never start", blocked)
+	} else if restarting.Len() > 0 {
+		eval.skipReason = fmt.Sprintf("containers %s terminated but will be restarted", restarting)
+	} else if pending.Len() > 0 {
+		eval.skipReason = fmt.Sprintf("containers %s are not ready to be evaluated yet", pending)
+	} else if !eval.running.Union(eval.completed).Equal(eval.all) {
+		eval.skipReason = fmt.Sprintf("containers %s are neither running nor completed",
+			eval.all.Difference(eval.running.Union(eval.completed)))
+	} else if eval.running.Len() == 0 {
+		eval.skipReason = "no containers are running"
+	} else if !eval.running.IsSubset(sidecars) {
+		// Sidecars that already exited on their own do not hold the
+		// others back
+		eval.skipReason = fmt.Sprintf("running containers %s are not all sidecars %s", eval.running, sidecars)
+	} else if eval.completed.Difference(sidecars).Len() == 0 {
+		// A pod made of sidecars only has no main work whose completion
+		// would end them
+		eval.skipReason = "no main container has completed"
+	} else if !c.terminateOnMainFailure && failed.Len() > 0 {
+		eval.skipReason = fmt.Sprintf("main containers %s failed, leaving sidecars running", failed)
+	}
+	return c.protect(eval)
+}
+
+// protect keeps the protected containers out of the targets of the
+// evaluation, the sidecars are not shut down when only protected containers
+// are running
+func (c *Controller) protect(eval podEvaluation) podEvaluation {
+	protected := eval.targets.Intersection(c.protectedContainers)
+	if protected.Len() == 0 {
+		return eval
+	}
+	eval.targets = eval.targets.Difference(protected)
+	if eval.shouldShutdown() && eval.targets.Len() == 0 {
+		eval.skipReason = fmt.Sprintf("only protected containers %s are running", protected)
+	}
+	return eval
+}
+
+// evaluateLenient completes the evaluation of a pod in lenient accounting,
+// whose running sidecars are shut down once every main container completed
+// whatever the state of the other sidecars
+func (c *Controller) evaluateLenient(eval podEvaluation, sidecars, failed stringSet) podEvaluation {
+	eval.targets = eval.running.Intersection(sidecars)
+	mains := eval.all.Difference(sidecars)
+	switch {
+	case mains.Len() == 0:
+		eval.skipReason = "no main container has completed"
+	case !mains.IsSubset(eval.completed):
+		eval.skipReason = fmt.Sprintf("main containers %s have not completed", mains.Difference(eval.completed))
+	case eval.targets.Len() == 0:
+		eval.skipReason = "no sidecars are running"
+	case !c.terminateOnMainFailure && failed.Len() > 0:
+		eval.skipReason = fmt.Sprintf("main containers %s failed, leaving sidecars running", failed)
+	}
+	return eval
+}
+
+// evaluatePrimary completes the evaluation of a pod with a primary container,
+// whose running sidecars are shut down once the primary container completed
+// whatever the state of the other main containers
+func (c *Controller) evaluatePrimary(eval podEvaluation, sidecars stringSet, primary *corev1.ContainerStatus, state ContainerState) podEvaluation {
+	eval.targets = eval.running.Intersection(sidecars)
+	if primary.State.Terminated != nil {
+		eval.finishedAt = primary.State.Terminated.FinishedAt.Time
+	}
+	switch {
+	case state == ContainerRestarting:
+		eval.skipReason = fmt.Sprintf("primary container %s terminated but will be restarted", primary.Name)
+	case state != ContainerCompleted && state != ContainerFailed:
+		eval.skipReason = fmt.Sprintf("primary container %s has not completed", primary.Name)
+	case eval.targets.Len() == 0:
+		eval.skipReason = "no sidecars are running"
+	case !c.terminateOnMainFailure && state == ContainerFailed:
+		eval.skipReason = fmt.Sprintf("primary container %s failed, leaving sidecars running", primary.Name)
+	}
+	return eval
+}
+
+// willRestart reports whether the kubelet restarts the terminated container,
+// which then has not truly completed even though it reports being terminated.
+// Under the OnFailure restart policy containers that exited unsuccessfully
+// are restarted, bumping their RestartCount, under Always every container
+// is, as native sidecars are whatever the policy of the pod. Nothing is
+// restarted anymore once the pod reached a terminal phase.
+func willRestart(pod *corev1.Pod, status corev1.ContainerStatus, native bool) bool {
+	terminated := status.State.Terminated
+	if terminated == nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return false
+	}
+	policy := pod.Spec.RestartPolicy
+	if native {
+		policy = corev1.RestartPolicyAlways
+	}
+	switch policy {
+	case corev1.RestartPolicyAlways:
+		return true
+	case corev1.RestartPolicyOnFailure:
+		return terminated.ExitCode != 0
+	default:
+		return false
+	}
+}
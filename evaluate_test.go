@@ -0,0 +1,265 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// evaluate evaluates the pod with the controller built from opts, the
+// sidecars being the containers named in opts.Sidecars
+func evaluate(t *testing.T, opts Options, pod *corev1.Pod) podEvaluation {
+	t.Helper()
+	f := newFixture(t, opts, pod)
+	sidecars, err := f.controller.sidecarsForPod(pod)
+	if err != nil {
+		t.Fatalf("sidecarsForPod() error = %v", err)
+	}
+	return f.controller.evaluatePod(pod, sidecars)
+}
+
+func TestEvaluatePodWaiting(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     corev1.ContainerStatus
+		wantReason string
+	}{
+		{name: "starting", status: waiting("app", "ContainerCreating"), wantReason: "not ready to be evaluated yet"},
+		{name: "no state yet", status: corev1.ContainerStatus{Name: "app"}, wantReason: "not ready to be evaluated yet"},
+		{name: "image pull backoff", status: waiting("app", "ImagePullBackOff"), wantReason: "blocked waiting and may never start"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eval := evaluate(t, newTestOptions(), newJobPod("pod", tt.status, running("istio-proxy")))
+			if eval.shouldShutdown() {
+				t.Fatal("shouldShutdown() = true with a waiting main container")
+			}
+			if !strings.Contains(eval.skipReason, tt.wantReason) {
+				t.Errorf("skipReason = %q, want it to contain %q", eval.skipReason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestEvaluatePodSidecarSubset(t *testing.T) {
+	opts := newTestOptions()
+	opts.Sidecars = []string{"istio-proxy", "vault-agent"}
+	tests := []struct {
+		name        string
+		pod         *corev1.Pod
+		wantTargets []string
+	}{
+		{
+			name:        "both sidecars running",
+			pod:         newJobPod("both", terminated("app", "Completed", 0), running("istio-proxy"), running("vault-agent")),
+			wantTargets: []string{"istio-proxy", "vault-agent"},
+		},
+		{
+			name:        "one sidecar exited",
+			pod:         newJobPod("one", terminated("app", "Completed", 0), running("istio-proxy"), terminated("vault-agent", "Completed", 0)),
+			wantTargets: []string{"istio-proxy"},
+		},
+		{
+			name: "both sidecars exited",
+			pod:  newJobPod("none", terminated("app", "Completed", 0), terminated("istio-proxy", "Completed", 0), terminated("vault-agent", "Error", 1)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eval := evaluate(t, opts, tt.pod)
+			if got := eval.shouldShutdown(); got != (len(tt.wantTargets) > 0) {
+				t.Fatalf("shouldShutdown() = %v, skipReason %q", got, eval.skipReason)
+			}
+			if len(tt.wantTargets) == 0 {
+				return
+			}
+			if got := eval.targets.ToSlice(); !equalStrings(got, tt.wantTargets) {
+				t.Errorf("targets = %v, want %v", got, tt.wantTargets)
+			}
+		})
+	}
+}
+
+func TestEvaluatePodSidecarOnly(t *testing.T) {
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+	}{
+		{name: "running sidecar", pod: newJobPod("pod", running("istio-proxy"))},
+		{name: "sidecars only", pod: newJobPod("pod", running("istio-proxy"), running("vault-agent"))},
+	}
+	opts := newTestOptions()
+	opts.Sidecars = []string{"istio-proxy", "vault-agent"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, opts, tt.pod)
+			if err := f.sync(tt.pod); err != nil {
+				t.Fatalf("syncHandler() error = %v", err)
+			}
+			if got := f.executor.containers(); len(got) != 0 {
+				t.Errorf("exec'd into %v of a pod without main containers", got)
+			}
+			eval := evaluate(t, opts, tt.pod)
+			if !strings.Contains(eval.skipReason, "no main container") {
+				t.Errorf("skipReason = %q, want it to mention the missing main container", eval.skipReason)
+			}
+		})
+	}
+}
+
+func TestEvaluatePodRestartPolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       corev1.RestartPolicy
+		phase        corev1.PodPhase
+		status       corev1.ContainerStatus
+		restartCount int32
+		want         bool
+		wantReason   string
+	}{
+		{name: "OnFailure completed", policy: corev1.RestartPolicyOnFailure, status: terminated("app", "Completed", 0), want: true},
+		{name: "OnFailure completed after restarts", policy: corev1.RestartPolicyOnFailure, status: terminated("app", "Completed", 0), restartCount: 2, want: true},
+		{name: "OnFailure error", policy: corev1.RestartPolicyOnFailure, status: terminated("app", "Error", 1), restartCount: 1, wantReason: "will be restarted"},
+		{name: "OnFailure restarted and running", policy: corev1.RestartPolicyOnFailure, status: running("app"), restartCount: 1, wantReason: "are not all sidecars"},
+		{name: "OnFailure error in failed pod", policy: corev1.RestartPolicyOnFailure, phase: corev1.PodFailed, status: terminated("app", "Error", 1), want: true},
+		{name: "Never error", policy: corev1.RestartPolicyNever, status: terminated("app", "Error", 1), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := newTestOptions()
+			opts.PodPhases = []string{string(corev1.PodRunning), string(corev1.PodFailed)}
+			tt.status.RestartCount = tt.restartCount
+			pod := newJobPod("pod", tt.status, running("istio-proxy"))
+			pod.Spec.RestartPolicy = tt.policy
+			if tt.phase != "" {
+				pod.Status.Phase = tt.phase
+			}
+			eval := evaluate(t, opts, pod)
+			if got := eval.shouldShutdown(); got != tt.want {
+				t.Fatalf("shouldShutdown() = %v, skipReason %q", got, eval.skipReason)
+			}
+			if !strings.Contains(eval.skipReason, tt.wantReason) {
+				t.Errorf("skipReason = %q, want it to contain %q", eval.skipReason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestDefaultClassifier(t *testing.T) {
+	tests := []struct {
+		name             string
+		successExitCodes []int32
+		completedReasons []string
+		status           corev1.ContainerStatus
+		sidecar          bool
+		want             ContainerState
+	}{
+		{name: "ready", status: running("app"), want: ContainerRunning},
+		{name: "completed", status: terminated("app", "Completed", 0), want: ContainerCompleted},
+		{name: "error", status: terminated("app", "Error", 1), want: ContainerFailed},
+		{name: "sidecar error", status: terminated("istio-proxy", "Error", 1), sidecar: true, want: ContainerCompleted},
+		{name: "oom killed", status: terminated("app", "OOMKilled", 137), want: ContainerOther},
+		{name: "waiting", status: waiting("app", "ContainerCreating"), want: ContainerPending},
+		{name: "image pull backoff", status: waiting("app", "ImagePullBackOff"), want: ContainerBlocked},
+		{
+			name:             "oom killed with completed reasons",
+			completedReasons: []string{"Completed", "Error", "OOMKilled"},
+			status:           terminated("app", "OOMKilled", 137),
+			want:             ContainerFailed,
+		},
+		{
+			name:             "success exit code",
+			successExitCodes: []int32{0, 2},
+			status:           terminated("app", "Error", 2),
+			want:             ContainerCompleted,
+		},
+		{
+			name:             "other exit code",
+			successExitCodes: []int32{0, 2},
+			status:           terminated("app", "Error", 1),
+			want:             ContainerFailed,
+		},
+		{
+			name:             "oom killed with success exit codes",
+			successExitCodes: []int32{0, 2},
+			status:           terminated("app", "OOMKilled", 137),
+			want:             ContainerFailed,
+		},
+		{
+			name:             "oom killed with success exit codes and completed reasons",
+			successExitCodes: []int32{0, 2},
+			completedReasons: []string{"Completed", "Error"},
+			status:           terminated("app", "OOMKilled", 137),
+			want:             ContainerOther,
+		},
+		{
+			name:             "success exit code and completed reasons",
+			successExitCodes: []int32{0, 2},
+			completedReasons: []string{"Completed", "Error"},
+			status:           terminated("app", "Error", 2),
+			want:             ContainerCompleted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			classifier := NewDefaultContainerClassifier(tt.successExitCodes, tt.completedReasons, RunningDetectionReady)
+			if got := classifier.Classify(tt.status, tt.sidecar); got != tt.want {
+				t.Errorf("Classify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluatePodAccountingMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		pod         *corev1.Pod
+		wantStrict  []string
+		wantLenient []string
+	}{
+		{
+			name:        "every container accounted for",
+			pod:         newJobPod("pod", terminated("app", "Completed", 0), running("istio-proxy"), running("vault-agent")),
+			wantStrict:  []string{"istio-proxy", "vault-agent"},
+			wantLenient: []string{"istio-proxy", "vault-agent"},
+		},
+		{
+			name:        "sidecar killed",
+			pod:         newJobPod("pod", terminated("app", "Completed", 0), running("istio-proxy"), terminated("vault-agent", "OOMKilled", 137)),
+			wantLenient: []string{"istio-proxy"},
+		},
+		{
+			name:        "sidecar blocked",
+			pod:         newJobPod("pod", terminated("app", "Completed", 0), running("istio-proxy"), waiting("vault-agent", "ImagePullBackOff")),
+			wantLenient: []string{"istio-proxy"},
+		},
+		{
+			name: "main container running",
+			pod:  newJobPod("pod", running("app"), running("istio-proxy"), running("vault-agent")),
+		},
+		{
+			name: "main container killed",
+			pod:  newJobPod("pod", terminated("app", "OOMKilled", 137), running("istio-proxy"), running("vault-agent")),
+		},
+	}
+	for _, tt := range tests {
+		for mode, want := range map[string][]string{AccountingStrict: tt.wantStrict, AccountingLenient: tt.wantLenient} {
+			t.Run(tt.name+"/"+mode, func(t *testing.T) {
+				opts := newTestOptions()
+				opts.Sidecars = []string{"istio-proxy", "vault-agent"}
+				opts.AccountingMode = mode
+				eval := evaluate(t, opts, tt.pod)
+				if got := eval.shouldShutdown(); got != (len(want) > 0) {
+					t.Fatalf("shouldShutdown() = %v, skipReason %q", got, eval.skipReason)
+				}
+				if len(want) == 0 {
+					return
+				}
+				if got := eval.targets.ToSlice(); !equalStrings(got, want) {
+					t.Errorf("targets = %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Executor runs commands in the containers of pods
+type Executor interface {
+	// Exec runs cmd in the container of the pod and returns its output.
+	// When stdin is not nil it is streamed to the standard input of cmd. A
+	// command exiting with a non-zero status is reported as an error
+	// implementing k8s.io/client-go/util/exec.ExitError.
+	Exec(ctx context.Context, namespace, pod, container string, cmd []string, stdin io.Reader) (stdout, stderr string, err error)
+}
+
+// spdyExecutor runs commands through the pods/exec subresource over SPDY
+type spdyExecutor struct {
+	kubeclientset  kubernetes.Interface
+	restConfig     *rest.Config
+	parameterCodec runtime.ParameterCodec
+}
+
+// NewSPDYExecutor returns an Executor using the pods/exec subresource of the
+// API server, authenticating with restConfig
+func NewSPDYExecutor(kubeclientset kubernetes.Interface, restConfig *rest.Config) Executor {
+	scheme := runtime.NewScheme()
+	// AddToScheme only fails for conflicting registrations, which a fresh
+	// scheme cannot have
+	_ = corev1.AddToScheme(scheme)
+	return &spdyExecutor{
+		kubeclientset:  kubeclientset,
+		restConfig:     restConfig,
+		parameterCodec: runtime.NewParameterCodec(scheme),
+	}
+}
+
+// Exec implements Executor
+func (e *spdyExecutor) Exec(ctx context.Context, namespace, pod, container string, cmd []string, stdin io.Reader) (string, string, error) {
+	// Build a fresh request for every exec, VersionedParams adds to the
+	// query of the request so reusing it would target the earlier
+	// containers as well
+	req := e.kubeclientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(pod).
+		Namespace(namespace).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Command:   cmd,
+			Container: container,
+			Stdin:     stdin != nil,
+			Stdout:    true,
+			Stderr:    true,
+			TTY:       false,
+		}, e.parameterCodec)
+
+	exec, err := remotecommand.NewSPDYExecutor(e.restConfig, "POST", req.URL())
+	if err != nil {
+		return "", "", fmt.Errorf("error creating executor: %w", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	err = exec.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: &stdout,
+		Stderr: &stderr,
+		Tty:    false,
+	})
+	if err != nil {
+		err = fmt.Errorf("error executing the stream: %w", err)
+	}
+	return stdout.String(), stderr.String(), err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestSPDYExecutorRequest(t *testing.T) {
+	var mu sync.Mutex
+	var execs []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/namespaces/default/pods/job-pod/exec") {
+			mu.Lock()
+			execs = append(execs, r.URL.Query())
+			mu.Unlock()
+		}
+		// Refuse the upgrade, the request is all that is checked
+		http.Error(w, "streams are not supported", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	restConfig := &rest.Config{Host: server.URL}
+	executor := NewSPDYExecutor(kubernetes.NewForConfigOrDie(restConfig), restConfig)
+
+	cmd := []string{"sh", "-c", DefaultShutdownCommand}
+	containers := []string{"istio-proxy", "vault-agent"}
+	for _, container := range containers {
+		if _, _, err := executor.Exec(context.Background(), "default", "job-pod", container, cmd, nil); err == nil {
+			t.Fatalf("Exec() into %s succeeded without a stream", container)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(execs) != len(containers) {
+		t.Fatalf("%d exec requests, want %d", len(execs), len(containers))
+	}
+	// Every request targets its own container only
+	for i, query := range execs {
+		if got, want := query["container"], []string{containers[i]}; !equalStrings(got, want) {
+			t.Errorf("request %d container = %v, want %v", i, got, want)
+		}
+		if got := query["command"]; !equalStrings(got, cmd) {
+			t.Errorf("request %d command = %v, want %v", i, got, cmd)
+		}
+		if got := query.Get("stdout"); got != "true" {
+			t.Errorf("request %d stdout = %q, want true", i, got)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+// TestIntegration runs the controller against the etcd and kube-apiserver of
+// envtest, the informers and the patches going through a real API server and
+// only the execs into the sidecars being stubbed. It needs the envtest
+// binaries, e.g. KUBEBUILDER_ASSETS=$(setup-envtest use -p path 1.28.x).
+func TestIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		t.Skip("skipping integration test, KUBEBUILDER_ASSETS is not set")
+	}
+
+	env := &envtest.Environment{}
+	cfg, err := env.Start()
+	if err != nil {
+		t.Fatalf("error starting envtest: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := env.Stop(); err != nil {
+			t.Errorf("error stopping envtest: %v", err)
+		}
+	})
+	client := kubernetes.NewForConfigOrDie(cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Without a kube-controller-manager the Job creates no pods of its own,
+	// the pod is created as if the Job controller did
+	job, err := client.BatchV1().Jobs(metav1.NamespaceDefault).Create(ctx, &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "job"},
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers:    []corev1.Container{{Name: "app", Image: "app"}},
+				},
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("error creating job: %v", err)
+	}
+	pod := newJobPod("job-pod", running("app"), running("istio-proxy"))
+	pod.UID = ""
+	pod.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(job, batchv1.SchemeGroupVersion.WithKind("Job"))}
+	status := pod.Status
+	pod, err = client.CoreV1().Pods(metav1.NamespaceDefault).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("error creating pod: %v", err)
+	}
+	pod.Status = status
+	if pod, err = client.CoreV1().Pods(metav1.NamespaceDefault).UpdateStatus(ctx, pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("error updating pod status: %v", err)
+	}
+
+	executor := &fakeExecutor{errs: map[string]error{}}
+	opts := newTestOptions()
+	opts.Executor = executor
+	factory := kubeinformers.NewSharedInformerFactory(client, 0)
+	controller, err := NewController(ctx, client, cfg, factory.Core().V1().Pods(), opts)
+	if err != nil {
+		t.Fatalf("error creating controller: %v", err)
+	}
+	factory.Start(ctx.Done())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := controller.Run(ctx, 1); err != nil {
+			t.Errorf("error running controller: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// Nothing is shut down while the main container runs
+	if err := wait.PollUntilContextTimeout(ctx, 100*time.Millisecond, 10*time.Second, true,
+		func(ctx context.Context) (bool, error) { return controller.Synced(), nil }); err != nil {
+		t.Fatalf("caches did not sync: %v", err)
+	}
+	time.Sleep(time.Second)
+	if got := executor.containers(); len(got) != 0 {
+		t.Fatalf("exec'd into %v while the main container runs", got)
+	}
+
+	pod.Status.ContainerStatuses[0] = terminated("app", "Completed", 0)
+	if _, err := client.CoreV1().Pods(metav1.NamespaceDefault).UpdateStatus(ctx, pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("error updating pod status: %v", err)
+	}
+	err = wait.PollUntilContextTimeout(ctx, 100*time.Millisecond, 30*time.Second, true,
+		func(ctx context.Context) (bool, error) {
+			current, err := client.CoreV1().Pods(metav1.NamespaceDefault).Get(ctx, pod.Name, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			return current.Annotations[SignaledAnnotation] != "", nil
+		})
+	if err != nil {
+		t.Fatalf("pod was not annotated as signaled: %v", err)
+	}
+	if got, want := executor.containers(), []string{"istio-proxy"}; !equalStrings(got, want) {
+		t.Errorf("exec'd into %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	batchinformers "k8s.io/client-go/informers/batch/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// WatchJobs enqueues the pods of every Job reaching a terminal condition, in
+// addition to the pods whose own status changes. The informer must be
+// started by the caller, Run waits for it to sync.
+func (c *Controller) WatchJobs(ctx context.Context, jobInformer batchinformers.JobInformer) {
+	c.jobsSynced = jobInformer.Informer().HasSynced
+	jobInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, new interface{}) {
+			c.handleJob(ctx, old, new)
+		},
+	})
+}
+
+// handleJob enqueues the pods owned by a Job that has just completed or
+// failed
+func (c *Controller) handleJob(ctx context.Context, old, new interface{}) {
+	oldJob, ok := old.(*batchv1.Job)
+	if !ok {
+		return
+	}
+	newJob, ok := new.(*batchv1.Job)
+	if !ok {
+		return
+	}
+	if jobFinished(oldJob) || !jobFinished(newJob) {
+		return
+	}
+
+	logger := klog.FromContext(ctx)
+	selector, err := metav1.LabelSelectorAsSelector(newJob.Spec.Selector)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("job '%s/%s': invalid selector: %w", newJob.Namespace, newJob.Name, err))
+		return
+	}
+	pods, err := c.podsLister.Pods(newJob.Namespace).List(selector)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("job '%s/%s': error listing pods: %w", newJob.Namespace, newJob.Name, err))
+		return
+	}
+	logger.V(4).Info("Job finished, enqueuing its pods", "job", klog.KObj(newJob))
+	for _, pod := range pods {
+		if ownerRef := c.ownerOf(pod); ownerRef != nil && ownerRef.UID == newJob.UID {
+			c.handleObject(pod)
+		}
+	}
+}
+
+// jobFinished reports whether the Job has the Complete or Failed condition
+func jobFinished(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if (condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed) &&
+			condition.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
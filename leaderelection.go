@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+
+	// serviceAccountNamespaceFile holds the namespace of the pod the
+	// controller runs in
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// runWithLeaderElection blocks until ctx is cancelled, calling run only while
+// this instance holds the Lease namespace/name. Standby instances wait to take
+// over when the leader stops renewing the Lease. A leader losing the Lease
+// exits the process, run cannot be started again and the other clusters of
+// the process must not keep running without this one. On a normal shutdown
+// the leader only releases the Lease once run returned, so that a standby
+// does not take over while its workers are still draining.
+func runWithLeaderElection(ctx context.Context, kubeClient kubernetes.Interface, namespace, name string, run func(ctx context.Context)) error {
+	logger := klog.FromContext(ctx)
+
+	namespace, err := leaseNamespace(namespace)
+	if err != nil {
+		return err
+	}
+
+	id, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("error getting hostname for leader election identity: %w", err)
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Client: kubeClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: id,
+		},
+	}
+
+	// The election runs with its own context: a standby stops competing as
+	// soon as ctx is cancelled, but the leader keeps renewing the Lease
+	// until run returned
+	electionCtx, cancel := context.WithCancel(withoutCancel{ctx})
+	defer cancel()
+	leading := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		select {
+		case <-leading:
+		default:
+			cancel()
+		}
+	}()
+
+	logger.Info("Starting leader election", "lease", klog.KRef(namespace, name), "identity", id)
+	leaderelection.RunOrDie(electionCtx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				close(leading)
+				defer cancel()
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				// The Lease is released on the way out when ctx is
+				// cancelled, that is not a loss
+				if ctx.Err() != nil {
+					logger.Info("Released leader election", "identity", id)
+					return
+				}
+				logger.Error(nil, "Leader election lost, exiting", "identity", id)
+				klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != id {
+					logger.Info("New leader elected", "leader", identity)
+				}
+			},
+		},
+	})
+	return nil
+}
+
+// leaseNamespace returns namespace, or the namespace the controller runs in
+// when it is empty
+func leaseNamespace(namespace string) (string, error) {
+	if namespace != "" {
+		return namespace, nil
+	}
+	data, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("leader election namespace not set and could not be detected: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
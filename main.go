@@ -1,60 +1,664 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
-	"k8s.io/sample-controller/pkg/signals"
-
 )
 
 var (
-	masterURL  string
-	kubeconfig string
+	masterURL         string
+	kubeconfig        string
+	kubeContexts      []string
+	insecureTLS       bool
+	caFile            string
+	kubeAPIQPS        float64
+	kubeAPIBurst      int
+	namespace         string
+	configMap         string
+	configFile        string
+	sidecarNames      string
+	sidecarMatchMode  string
+	sidecarMatchBy    string
+	requireOptIn      bool
+	shutdownCommand   string
+	shutdownStrategy  string
+	quitPort          int
+	killTarget        string
+	shutdownScript    string
+	execShell         string
+	runningDetection  string
+	accountingMode    string
+	discoverPID       string
+	primaryContainer  string
+	metricsAddr       string
+	enablePprof       bool
+	healthAddr        string
+	dryRun            bool
+	reportOnly        bool
+	disableEvents     bool
+	eventComponent    string
+	eventInstance     string
+	autoDetectIstio   bool
+	webhookURL        string
+	webhookTimeout    time.Duration
+	anyOwner          bool
+	ignorePodPhase    bool
+	recheckInterval   time.Duration
+	maxRechecks       int
+	watchNamespaces   string
+	excludeNamespaces string
+	podSelector       string
+	shutdownDelay     time.Duration
+	shutdownOrder     string
+	drainTimeout      time.Duration
+	maxRetries        int
+	requeueBaseDelay  time.Duration
+	requeueMaxDelay   time.Duration
+	requeueJitter     float64
+	maxWait           time.Duration
+	deleteOnGiveUp    bool
+	deleteGrace       time.Duration
+	ownerKinds        string
+	podPhases         string
+	ignoreContainers  string
+	successExitCodes  string
+	execTimeout       time.Duration
+	syncTimeout       time.Duration
+	maxExecs          int
+	workers           int
+	escalationGrace   time.Duration
+	verifyTermination bool
+	verifyChecks      int
+	verifyCommand     string
+	ephemeralFallback bool
+	ephemeralImage    string
+
+	terminateOnMainFailure bool
+	protectedContainers    string
+	completedReasons       string
+
+	enableLeaderElection    bool
+	leaderElectionNamespace string
+	leaderElectionID        string
+
+	validateOnly bool
+	watchJobs    bool
 )
 
 func main() {
 	klog.InitFlags(nil)
+	registerFlags(flag.CommandLine)
 	flag.Parse()
 
 	// set up signals so we handle the shutdown signal gracefully
-	ctx := signals.SetupSignalHandler()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 	logger := klog.FromContext(ctx)
 
-	cfg, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfig)
+	if configFile != "" {
+		if err := loadConfigFile(configFile); err != nil {
+			logger.Error(err, "Error loading config file")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+	}
+
+	exitCodes, err := parseExitCodes(successExitCodes)
 	if err != nil {
-		logger.Error(err, "Error building kubeconfig")
+		logger.Error(err, "Invalid --success-exit-codes")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+
+	opts := Options{
+		Sidecars:           strings.Split(sidecarNames, ","),
+		SidecarMatchMode:   sidecarMatchMode,
+		SidecarMatchBy:     sidecarMatchBy,
+		RequireOptIn:       requireOptIn,
+		ShutdownCommand:    shutdownCommand,
+		ShutdownStrategy:   shutdownStrategy,
+		QuitPort:           quitPort,
+		KillTarget:         killTarget,
+		ExecShell:          execShell,
+		RunningDetection:   runningDetection,
+		AccountingMode:     accountingMode,
+		DryRun:             dryRun,
+		WatchNamespaces:    strings.Split(watchNamespaces, ","),
+		ExcludeNamespaces:  strings.Split(excludeNamespaces, ","),
+		ShutdownDelay:      shutdownDelay,
+		ShutdownOrder:      strings.Split(shutdownOrder, ","),
+		DrainTimeout:       drainTimeout,
+		MaxRetries:         maxRetries,
+		RequeueBaseDelay:   requeueBaseDelay,
+		RequeueMaxDelay:    requeueMaxDelay,
+		RequeueJitter:      requeueJitter,
+		OwnerKinds:         strings.Split(ownerKinds, ","),
+		PodPhases:          strings.Split(podPhases, ","),
+		IgnoreContainers:   strings.Split(ignoreContainers, ","),
+		SuccessExitCodes:   exitCodes,
+		ExecTimeout:        execTimeout,
+		SyncTimeout:        syncTimeout,
+		MaxConcurrentExecs: maxExecs,
+		EscalationGrace:    escalationGrace,
+
+		TerminateOnMainFailure:  terminateOnMainFailure,
+		MaxWaitAfterCompletion:  maxWait,
+		DeletePodOnGiveUp:       deleteOnGiveUp,
+		DeleteGracePeriod:       deleteGrace,
+		ReportOnly:              reportOnly,
+		DisableEvents:           disableEvents,
+		DiscoverPIDByName:       discoverPID,
+		PrimaryContainer:        primaryContainer,
+		VerifyTermination:       verifyTermination,
+		VerifyTerminationChecks: verifyChecks,
+		AllowEphemeralFallback:  ephemeralFallback,
+		EphemeralImage:          ephemeralImage,
+		EventComponent:          eventComponent,
+		EventInstance:           eventInstance,
+		AutoDetectIstio:         autoDetectIstio,
+
+		PreShutdownWebhook:        webhookURL,
+		PreShutdownWebhookTimeout: webhookTimeout,
+		NonControllerOwners:       anyOwner,
+		IgnorePodPhase:            ignorePodPhase,
+		RecheckInterval:           recheckInterval,
+		MaxRechecks:               maxRechecks,
+		VerifyCommand:             verifyCommand,
+		ProtectedContainers:       strings.Split(protectedContainers, ","),
+		CompletedReasons:          strings.Split(completedReasons, ","),
+	}
+	if shutdownScript != "" {
+		script, err := os.ReadFile(shutdownScript)
+		if err != nil {
+			logger.Error(err, "Error reading shutdown script", "file", shutdownScript)
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+		opts.ShutdownScript = string(script)
+	}
+	if err := opts.Validate(); err != nil {
+		logger.Error(err, "Invalid configuration")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+
+	var configMapNamespace, configMapName string
+	if configMap != "" {
+		configMapNamespace, configMapName, err = cache.SplitMetaNamespaceKey(configMap)
+		if err != nil || configMapNamespace == "" {
+			logger.Error(err, "Invalid --config-map, expected namespace/name", "configMap", configMap)
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+	}
+
+	// Fail before connecting to the cluster rather than when the informer
+	// first lists the pods
+	if _, err := labels.Parse(podSelector); err != nil {
+		logger.Error(err, "Invalid --pod-selector", "podSelector", podSelector)
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
+	logEffectiveConfig(logger, opts)
+
+	// One controller runs per kubeconfig context, against the current
+	// context or the in-cluster config when none is given
+	contexts := kubeContexts
+	if len(contexts) == 0 {
+		contexts = []string{""}
+	}
+	clusters := make([]*cluster, 0, len(contexts))
+	for _, kubeContext := range contexts {
+		cl, err := newCluster(ctx, kubeContext)
+		if err != nil {
+			logger.Error(err, "Error building kubernetes clientset", "context", kubeContext)
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+		clusters = append(clusters, cl)
+	}
+
+	if validateOnly {
+		perms, err := requiredPermissions(configMapNamespace)
+		if err != nil {
+			logger.Error(err, "Error validating configuration")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+		valid := true
+		for _, cl := range clusters {
+			missing, err := validateAccess(cl.ctx, cl.kubeClient, perms)
+			if err != nil {
+				logger.Error(err, "Error validating configuration", "context", cl.context)
+				klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+			}
+			if len(missing) > 0 {
+				valid = false
+				if cl.context != "" {
+					fmt.Fprintf(os.Stderr, "In context %s the controller is missing the permissions to:\n", cl.context)
+				} else {
+					fmt.Fprintln(os.Stderr, "The controller is missing the permissions to:")
+				}
+				for _, p := range missing {
+					fmt.Fprintln(os.Stderr, "  "+p.String())
+				}
+			}
+		}
+		if !valid {
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+		fmt.Println("Configuration is valid")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 0)
+	}
+
+	// The provider must be set before the workqueue is built
+	workqueue.SetProvider(workqueueMetricsProvider{})
+
+	for _, cl := range clusters {
+		if err := cl.setup(opts, configMapNamespace, configMapName); err != nil {
+			logger.Error(err, "Error building controller", "context", cl.context)
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+	}
+
+	if metricsAddr != "" {
+		go serveMetrics(logger, metricsAddr, enablePprof)
+	}
+	if healthAddr != "" {
+		go serveHealth(ctx, logger, healthAddr, clusters)
+	}
+
+	// Every controller stops once ctx is cancelled, wait for all of them
+	// to drain
+	var wg sync.WaitGroup
+	for _, cl := range clusters {
+		wg.Add(1)
+		go func(cl *cluster) {
+			defer wg.Done()
+			cl.run()
+		}(cl)
+	}
+	wg.Wait()
+}
+
+// cluster is the controller running against a single kubeconfig context
+type cluster struct {
+	// context is the kubeconfig context, empty for the current one
+	context string
+	// ctx carries a logger naming the context
+	ctx        context.Context
+	cfg        *rest.Config
+	kubeClient kubernetes.Interface
+	controller *Controller
+	// informers are started by setup
+	informers []kubeinformers.SharedInformerFactory
+	// stopped is set once the controller stopped running, failing the
+	// liveness check of the process
+	stopped atomic.Bool
+}
+
+// newCluster builds the clientset for the kubeconfig context
+func newCluster(ctx context.Context, kubeContext string) (*cluster, error) {
+	if kubeContext != "" {
+		ctx = klog.NewContext(ctx, klog.LoggerWithValues(klog.FromContext(ctx), "context", kubeContext))
+	}
+	cfg, err := buildConfig(masterURL, kubeconfig, kubeContext)
+	if err != nil {
+		return nil, fmt.Errorf("error building kubeconfig: %w", err)
+	}
+	applyTLSOptions(cfg, insecureTLS, caFile)
+	// The exec streams and the Events count against the same limits as the
+	// other API calls
+	cfg.QPS = float32(kubeAPIQPS)
+	cfg.Burst = kubeAPIBurst
 
 	//build kubernetes rest client config
 	kubeClient, err := kubernetes.NewForConfig(cfg)
 	if err != nil {
-		logger.Error(err, "Error building kubernetes clientset")
-		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		return nil, err
 	}
-    
-    //create new kubernetes informer to cache resources
-	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(kubeClient, time.Second*30)
+	return &cluster{context: kubeContext, ctx: ctx, cfg: cfg, kubeClient: kubeClient}, nil
+}
+
+// setup builds the controller of the cluster with its informers
+func (cl *cluster) setup(opts Options, configMapNamespace, configMapName string) error {
+	opts.Context = cl.context
+
+	//create new kubernetes informer to cache resources, restricted to a
+	//single namespace when --namespace is set and to the pods matching
+	//--pod-selector
+	kubeInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(cl.kubeClient, time.Second*30,
+		kubeinformers.WithNamespace(namespace),
+		kubeinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = podSelector
+		}))
 
 	//Instantiate Controller
-	controller := NewController(ctx, kubeClient,
-		kubeInformerFactory.Core().V1().Pods())
+	controller, err := NewController(cl.ctx, cl.kubeClient, cl.cfg,
+		kubeInformerFactory.Core().V1().Pods(),
+		opts)
+	if err != nil {
+		return err
+	}
+	cl.controller = controller
+	cl.informers = append(cl.informers, kubeInformerFactory)
+
+	if watchJobs {
+		// The pod selector does not apply to the Jobs, whose labels differ
+		// from those of their pods
+		jobInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(cl.kubeClient, time.Second*30,
+			kubeinformers.WithNamespace(namespace))
+		controller.WatchJobs(cl.ctx, jobInformerFactory.Batch().V1().Jobs())
+		cl.informers = append(cl.informers, jobInformerFactory)
+	}
+
+	if configMapName != "" {
+		// watch only the configuration ConfigMap
+		configMapInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(cl.kubeClient, 0,
+			kubeinformers.WithNamespace(configMapNamespace),
+			kubeinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector("metadata.name", configMapName).String()
+			}))
+		controller.WatchConfigMap(cl.ctx, configMapInformerFactory.Core().V1().ConfigMaps(), configMapNamespace, configMapName)
+		cl.informers = append(cl.informers, configMapInformerFactory)
+	}
 
 	// Start method is non-blocking and runs all registered informers in a dedicated goroutine.
-	kubeInformerFactory.Start(ctx.Done())
+	for _, factory := range cl.informers {
+		factory.Start(cl.ctx.Done())
+	}
+	return nil
+}
 
-	if err = controller.Run(ctx, 2); err != nil {
-		logger.Error(err, "Error running controller")
+// run runs the controller of the cluster, under leader election when it is
+// enabled, until the context is cancelled
+func (cl *cluster) run() {
+	defer cl.stopped.Store(true)
+	logger := klog.FromContext(cl.ctx)
+	run := func(ctx context.Context) {
+		if err := cl.controller.Run(ctx, workers); err != nil {
+			logger.Error(err, "Error running controller")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+	}
+
+	if !enableLeaderElection {
+		run(cl.ctx)
+		return
+	}
+
+	if err := runWithLeaderElection(cl.ctx, cl.kubeClient, leaderElectionNamespace, leaderElectionID, run); err != nil {
+		logger.Error(err, "Error running leader election")
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
 }
 
-func init() {
-	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
-	flag.StringVar(&masterURL, "master", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
+// logEffectiveConfig logs the configuration resolved from the flags and the
+// config file as a single line, to tell which settings actually took effect.
+// Settings the ConfigMap reloads later on are logged again by the controller.
+func logEffectiveConfig(logger klog.Logger, opts Options) {
+	logger.Info("Effective configuration",
+		"sidecars", opts.Sidecars,
+		"sidecarMatchMode", opts.SidecarMatchMode,
+		"sidecarMatchBy", opts.SidecarMatchBy,
+		"shutdownStrategy", opts.ShutdownStrategy,
+		"shutdownCommand", opts.ShutdownCommand,
+		"shutdownScript", shutdownScript,
+		"shutdownDelay", opts.ShutdownDelay,
+		"shutdownOrder", opts.ShutdownOrder,
+		"namespace", namespace,
+		"watchNamespaces", opts.WatchNamespaces,
+		"excludeNamespaces", opts.ExcludeNamespaces,
+		"ownerKinds", opts.OwnerKinds,
+		"podSelector", podSelector,
+		"requireOptIn", opts.RequireOptIn,
+		"accountingMode", opts.AccountingMode,
+		"runningDetection", opts.RunningDetection,
+		"completedReasons", opts.CompletedReasons,
+		"execTimeout", opts.ExecTimeout,
+		"syncTimeout", opts.SyncTimeout,
+		"maxRetries", opts.MaxRetries,
+		"workers", workers,
+		"dryRun", opts.DryRun,
+		"reportOnly", opts.ReportOnly,
+		"contexts", kubeContexts,
+		"configMap", configMap)
+}
+
+// parseExitCodes parses a comma separated list of container exit codes
+func parseExitCodes(list string) ([]int32, error) {
+	var codes []int32
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		code, err := strconv.ParseInt(item, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exit code %q: %w", item, err)
+		}
+		codes = append(codes, int32(code))
+	}
+	return codes, nil
+}
+
+// buildConfig builds the rest config shared by the clientset and the exec
+// streams. It uses the in-cluster config unless a kubeconfig is given by
+// --kubeconfig or the KUBECONFIG environment variable, or --master or a
+// kubeconfig context is set. An empty kubeContext selects the current context.
+func buildConfig(masterURL, kubeconfig, kubeContext string) (*rest.Config, error) {
+	if kubeconfig == "" && masterURL == "" && kubeContext == "" && os.Getenv(clientcmd.RecommendedConfigPathEnvVar) == "" {
+		return rest.InClusterConfig()
+	}
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+	overrides := &clientcmd.ConfigOverrides{
+		ClusterInfo:    clientcmdapi.Cluster{Server: masterURL},
+		CurrentContext: kubeContext,
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+}
+
+// applyTLSOptions overrides the TLS settings of cfg, which the clientset and
+// the exec streams share. insecure skips verifying the API server
+// certificate, caFile replaces the CA bundle it is verified against.
+func applyTLSOptions(cfg *rest.Config, insecure bool, caFile string) {
+	if caFile != "" {
+		cfg.TLSClientConfig.CAFile = caFile
+		cfg.TLSClientConfig.CAData = nil
+	}
+	if insecure {
+		// client-go refuses a CA together with an insecure config
+		cfg.TLSClientConfig.Insecure = true
+		cfg.TLSClientConfig.CAFile = ""
+		cfg.TLSClientConfig.CAData = nil
+	}
+}
+
+// serveMetrics exposes the prometheus metrics on addr, and the pprof
+// profiles under /debug/pprof/ with enablePprof
+func serveMetrics(logger klog.Logger, addr string, enablePprof bool) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	logger.Info("Serving metrics", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Error(err, "Error serving metrics")
+	}
+}
+
+// serveHealth serves the healthMux of the clusters on addr
+func serveHealth(ctx context.Context, logger klog.Logger, addr string, clusters []*cluster) {
+	logger.Info("Serving health checks", "addr", addr)
+	if err := http.ListenAndServe(addr, healthMux(ctx, logger, clusters)); err != nil {
+		logger.Error(err, "Error serving health checks")
+	}
+}
+
+// healthMux exposes the liveness and readiness checks of the controllers.
+// /healthz succeeds once the controller of every cluster has started, or
+// waits for its Lease under leader election, as long as none of them
+// stopped, and /readyz once the caches of every controller have synced, as
+// long as none of them is degraded. A POST to
+// /resync enqueues the pods of every controller again.
+func healthMux(ctx context.Context, logger klog.Logger, clusters []*cluster) *http.ServeMux {
+	controllers := make([]*Controller, 0, len(clusters))
+	for _, cl := range clusters {
+		controllers = append(controllers, cl.controller)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", checkHandler(func() bool {
+		for _, cl := range clusters {
+			// Standby replicas only run their controller once they take
+			// the Lease over
+			if (!cl.controller.Started() && !enableLeaderElection) || cl.stopped.Load() {
+				return false
+			}
+		}
+		return true
+	}))
+	mux.HandleFunc("/readyz", checkHandler(func() bool {
+		for _, controller := range controllers {
+			if !controller.Synced() || controller.Degraded() {
+				return false
+			}
+		}
+		return true
+	}))
+	mux.HandleFunc("/resync", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		total := 0
+		for _, controller := range controllers {
+			n, err := controller.Resync(ctx)
+			if err != nil {
+				logger.Error(err, "Error resyncing pods")
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			total += n
+		}
+		fmt.Fprintf(w, "resynced %d pods\n", total)
+	})
+	return mux
+}
+
+// checkHandler responds with 200 while check passes and 503 otherwise
+func checkHandler(check func() bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !check() {
+			http.Error(w, "not ok", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+}
+
+// registerFlags registers the flags of the controller on fs. It is called by
+// main rather than an init function, so that the tests can link packages
+// registering flags of the same name, such as --kubeconfig.
+func registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster, defaults to the KUBECONFIG environment variable.")
+	fs.Func("context", "Kubeconfig context to run a controller against. Repeat it to run one controller per context, all with the same configuration. Defaults to the current context.", func(value string) error {
+		kubeContexts = append(kubeContexts, value)
+		return nil
+	})
+	fs.StringVar(&masterURL, "master", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
+	fs.BoolVar(&insecureTLS, "insecure-skip-tls-verify", false, "Do not verify the API server certificate, for the API calls and the exec streams alike. Only meant for development clusters.")
+	fs.StringVar(&caFile, "certificate-authority", "", "Path to a CA bundle to verify the API server certificate with, for the API calls and the exec streams alike.")
+	fs.Float64Var(&kubeAPIQPS, "kube-api-qps", float64(rest.DefaultQPS), "Queries per second the controller may send to the API server, execs and Events included.")
+	fs.IntVar(&kubeAPIBurst, "kube-api-burst", rest.DefaultBurst, "Burst of queries the controller may send to the API server above --kube-api-qps.")
+	fs.StringVar(&namespace, "namespace", "", "Only watch pods in this namespace. All namespaces are watched when empty.")
+	fs.StringVar(&configFile, "config", "", "Path to a YAML file setting the flags, e.g. sidecarNames and shutdownDelay. Flags given on the command line take precedence over the file.")
+	fs.StringVar(&configMap, "config-map", "", "Namespace and name, as namespace/name, of a ConfigMap to reload the sidecar-names, shutdown-command and shutdown-delay settings from while running.")
+	fs.StringVar(&ownerKinds, "owner-kinds", "Job", "Comma separated list of the Kinds of controllers whose pods are handled, e.g. Job,Workflow,TaskRun.")
+	fs.BoolVar(&anyOwner, "allow-non-controller-owners", false, "Also handle pods without a controller that list an owner of one of the --owner-kinds. That owner may not be the one managing the pod.")
+	fs.StringVar(&podPhases, "pod-phases", string(corev1.PodRunning), "Comma separated list of the pod phases in which pods are handled.")
+	fs.BoolVar(&ignorePodPhase, "ignore-pod-phase", false, "Handle pods whatever their phase, relying on the states of their containers alone. Overrides --pod-phases.")
+	fs.StringVar(&sidecarNames, "sidecar-names", "istio-proxy", "Comma separated list of sidecar container names. Can be overridden per pod with the "+SidecarsAnnotation+" annotation.")
+	fs.StringVar(&sidecarMatchMode, "sidecar-match-mode", SidecarMatchExact, "How container names are matched against the sidecar names, one of \"exact\", \"glob\" or \"regex\".")
+	fs.StringVar(&sidecarMatchBy, "sidecar-match-by", SidecarMatchByName, "What the sidecar names are matched against, \"name\" for the container names or \"image\" for the container images.")
+	fs.BoolVar(&autoDetectIstio, "auto-detect-istio", false, "Add the containers listed in the sidecar.istio.io/status annotation of a pod to its sidecars.")
+	fs.StringVar(&primaryContainer, "primary-container", "", "Name of the container whose completion alone triggers the shutdown of the sidecars, whatever the state of the other main containers. Can be overridden per pod with the "+PrimaryContainerAnnotation+" annotation.")
+	fs.StringVar(&ignoreContainers, "ignore-containers", "", "Comma separated list of containers, such as debug containers, left out when deciding whether only sidecars are still running.")
+	fs.StringVar(&protectedContainers, "protected-containers", "", "Comma separated list of containers that may keep running like sidecars without holding up the shutdown, but are never shut down themselves.")
+	fs.StringVar(&successExitCodes, "success-exit-codes", "", "Comma separated list of exit codes, e.g. 0,2, with which main containers count as successful whatever their termination reason. When empty, main containers terminated with the Error reason count as failed.")
+	fs.StringVar(&completedReasons, "completed-reasons", "", "Comma separated list of the termination reasons of containers that count as completed, e.g. Completed,Error,OOMKilled. When empty every reason counts with --success-exit-codes, and Completed,Error without. Unless --success-exit-codes decides by exit code, main containers terminated with any other reason than Completed count as failed.")
+	fs.StringVar(&runningDetection, "running-detection", RunningDetectionReady, "How running containers are detected, \"ready\" for Ready containers, \"state\" for containers in the Running state whether they are Ready or not, or \"sidecar-state\" for the latter applied to sidecars only.")
+	fs.StringVar(&accountingMode, "accounting-mode", AccountingStrict, "\"strict\" shuts the sidecars down once every container is either running or completed, \"lenient\" once every main container completed whatever the state of the sidecars.")
+	fs.BoolVar(&watchJobs, "watch-jobs", false, "Also watch Jobs and re-evaluate the pods of a Job as soon as it completes or fails.")
+	fs.BoolVar(&requireOptIn, "require-opt-in", false, "Only handle pods annotated with "+EnabledAnnotation+"=\"true\".")
+	fs.StringVar(&shutdownCommand, "shutdown-command", DefaultShutdownCommand, "Command run in each sidecar container to shut it down, with -c by the --exec-shell, or split on spaces with --exec-shell=none.")
+	fs.StringVar(&shutdownStrategy, "shutdown-strategy", ShutdownStrategySignal, "How sidecars are shut down, either \"signal\" to run the shutdown command or \"quitquitquit\" to call the istio pilot-agent quit endpoint.")
+	fs.IntVar(&quitPort, "quit-port", DefaultQuitPort, "Port of the pilot-agent /quitquitquit endpoint used by the quitquitquit shutdown strategy.")
+	fs.StringVar(&discoverPID, "discover-pid-by-name", "", "pgrep -f pattern matching the command line of the sidecar process to signal in place of PID 1. Sidecars without a matching process are skipped.")
+	fs.StringVar(&execShell, "exec-shell", ExecShellSh, "Shell running the shutdown command with -c, \"sh\" or \"bash\", or \"none\" to run the command split on spaces directly in sidecars without a shell.")
+	fs.BoolVar(&ephemeralFallback, "allow-ephemeral-fallback", false, "Signal sidecars without a shell or binary to run the shutdown command with from an ephemeral container targeting them. Needs update on pods/ephemeralcontainers.")
+	fs.StringVar(&ephemeralImage, "ephemeral-image", DefaultEphemeralImage, "Image of the ephemeral containers added with --allow-ephemeral-fallback, it must provide sh and kill.")
+	fs.StringVar(&shutdownScript, "shutdown-script-file", "", "Path to a shell script streamed to the standard input of the --exec-shell, run with -s, in each sidecar container in place of running the shutdown command. Needs a shell, it cannot be used with --exec-shell=none.")
+	fs.StringVar(&killTarget, "kill-target", KillTargetPID1, "Process signaled in the sidecars, either \"pid1\" to run the shutdown command or \"process:<name>\" to signal the processes of that name with pkill.")
+	fs.BoolVar(&terminateOnMainFailure, "terminate-on-main-failure", true, "Shut sidecars down when a main container failed. When false they are left running for debugging.")
+	fs.DurationVar(&shutdownDelay, "shutdown-delay", 0, "Grace period between the main containers finishing and the sidecars being shut down.")
+	fs.StringVar(&shutdownOrder, "shutdown-order", "", "Comma separated list of sidecars in the order they are shut down, each waiting for the previous one to terminate. Can be overridden per pod with the "+OrderAnnotation+" annotation.")
+	fs.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "How long to wait for in-flight work to finish when the controller is stopped.")
+	fs.StringVar(&webhookURL, "pre-shutdown-webhook", "", "URL the pod and its sidecars are posted to as JSON before the sidecars are shut down. The shutdown only proceeds when it answers 200, it is asked again every 30s otherwise.")
+	fs.DurationVar(&webhookTimeout, "pre-shutdown-webhook-timeout", 10*time.Second, "Timeout of the calls to --pre-shutdown-webhook.")
+	fs.DurationVar(&escalationGrace, "escalation-grace", 0, "How long a sidecar may keep running after the shutdown command before it is sent the KILL signal. 0 disables escalation.")
+	fs.BoolVar(&verifyTermination, "verify-termination", false, "Check that the signaled sidecars terminated, warning about those still running after the last check and escalating when --escalation-grace is set.")
+	fs.IntVar(&verifyChecks, "verify-termination-checks", 3, "Number of checks, 10s apart, that the signaled sidecars terminated with --verify-termination.")
+	fs.StringVar(&verifyCommand, "verify-command", "", "Command run in every signaled sidecar to confirm its process exited, which it reports by exiting with a non-zero status, e.g. 'pgrep -f envoy'. Disabled when empty.")
+	fs.IntVar(&workers, "workers", 2, "Number of pods processed concurrently.")
+	fs.DurationVar(&execTimeout, "exec-timeout", 15*time.Second, "Timeout for each exec into a sidecar container.")
+	fs.DurationVar(&syncTimeout, "sync-timeout", 0, "Timeout for the whole sync of a pod, all its execs included, after which it is requeued with a backoff. 0 disables it.")
+	fs.IntVar(&maxExecs, "max-concurrent-execs", 10, "Maximum number of execs into sidecar containers open at the same time across all workers.")
+	fs.DurationVar(&recheckInterval, "recheck-interval", 0, "Requeue pods not ready for their sidecars to be shut down yet after this delay, in case a later transition is missed. 0 disables it.")
+	fs.IntVar(&maxRechecks, "max-rechecks", 10, "Maximum number of times a pod is requeued with --recheck-interval.")
+	fs.IntVar(&maxRetries, "max-retries", 5, "How many times a pod whose sidecars fail to shut down is retried before giving up. 0 retries forever.")
+	fs.DurationVar(&maxWait, "max-wait-after-completion", 0, "How long after the main containers finished the controller keeps retrying to shut the sidecars down before giving up with a Warning Event. 0 keeps retrying.")
+	fs.BoolVar(&deleteOnGiveUp, "delete-pod-on-give-up", false, "Delete the pods whose sidecars still fail to shut down after --max-retries retries. This is destructive.")
+	fs.DurationVar(&deleteGrace, "delete-grace-period", 30*time.Second, "Grace period of the pods deleted with --delete-pod-on-give-up.")
+	fs.DurationVar(&requeueBaseDelay, "requeue-base-delay", 5*time.Millisecond, "Delay before a failing pod is first retried, doubled on every further retry.")
+	fs.DurationVar(&requeueMaxDelay, "requeue-max-delay", 1000*time.Second, "Maximum delay between the retries of a failing pod.")
+	fs.Float64Var(&requeueJitter, "requeue-jitter", 0, "Largest fraction of its delay added at random to each retry of a failing pod, e.g. 0.1, so that pods failing together are not retried together. The delay never exceeds --requeue-max-delay. 0 disables it.")
+	fs.BoolVar(&reportOnly, "report-only", false, "Never shut sidecars down, only log the pods whose sidecars would be and export their number as the sidecar_candidates metric.")
+	fs.BoolVar(&disableEvents, "disable-events", false, "Do not record any Event, only log.")
+	fs.StringVar(&eventComponent, "event-component", controllerAgentName, "Component the recorded Events are attributed to.")
+	fs.StringVar(&eventInstance, "event-instance", "", "Identifier of this instance, recorded as the host of the Events' source to tell several instances apart.")
+	fs.BoolVar(&dryRun, "dry-run", false, "Log and record an Event for the shutdown commands instead of executing them.")
+	fs.StringVar(&watchNamespaces, "watch-namespaces", "", "Comma separated list of namespaces to handle pods in. All namespaces are handled when empty.")
+	fs.StringVar(&podSelector, "pod-selector", "", "Label selector restricting the pods watched, e.g. sidecar-terminate=enabled. All pods are watched when empty.")
+	fs.StringVar(&excludeNamespaces, "exclude-namespaces", "", "Comma separated list of namespaces to never handle pods in. Takes precedence over --watch-namespaces.")
+	fs.StringVar(&metricsAddr, "metrics-addr", ":8080", "Address the prometheus /metrics endpoint listens on. Empty disables it.")
+	fs.BoolVar(&enablePprof, "enable-pprof", false, "Serve the pprof profiles under /debug/pprof/ on the metrics address.")
+	fs.StringVar(&healthAddr, "health-addr", ":8081", "Address the /healthz and /readyz endpoints listen on. Empty disables them.")
+	fs.BoolVar(&enableLeaderElection, "enable-leader-election", false, "Elect a leader through a Lease so that only one of several replicas runs the controller.")
+	fs.StringVar(&leaderElectionNamespace, "leader-election-namespace", "", "Namespace of the leader election Lease. Defaults to the namespace the controller runs in.")
+	fs.StringVar(&leaderElectionID, "leader-election-id", controllerAgentName, "Name of the leader election Lease.")
+	fs.BoolVar(&validateOnly, "validate", false, "Validate the flags, the connection to the API server and the RBAC permissions of the controller, then exit.")
 }
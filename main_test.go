@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/klog/v2"
+)
+
+func TestHealthMux(t *testing.T) {
+	f := newFixture(t, newTestOptions())
+	prod, staging := &cluster{context: "prod", controller: f.controller}, &cluster{context: "staging", controller: f.controller}
+	mux := healthMux(f.ctx, klog.Background(), []*cluster{prod, staging})
+	check := func(path string, want int) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("GET %s = %d, want %d", path, rec.Code, want)
+		}
+	}
+
+	// Run is never called on the controller of the fixture, nor is its
+	// informer started
+	check("/healthz", http.StatusServiceUnavailable)
+	check("/readyz", http.StatusServiceUnavailable)
+
+	f.controller.started.Store(true)
+	check("/healthz", http.StatusOK)
+
+	// A cluster whose controller stopped, e.g. after losing its Lease,
+	// fails the liveness of the whole process
+	staging.stopped.Store(true)
+	check("/healthz", http.StatusServiceUnavailable)
+}
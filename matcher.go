@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// SidecarMatchExact matches container names against the sidecar names
+	// as they are
+	SidecarMatchExact = "exact"
+	// SidecarMatchGlob treats the sidecar names as shell glob patterns
+	SidecarMatchGlob = "glob"
+	// SidecarMatchRegex treats the sidecar names as regular expressions
+	// matching the whole container name
+	SidecarMatchRegex = "regex"
+)
+
+const (
+	// SidecarMatchByName matches the sidecar patterns against the names of
+	// the containers
+	SidecarMatchByName = "name"
+	// SidecarMatchByImage matches the sidecar patterns against the images
+	// of the containers, e.g. the regex .*istio/proxyv2.*
+	SidecarMatchByImage = "image"
+)
+
+// sidecarMatcher decides whether a container is a sidecar by matching its
+// name against the configured sidecar names or patterns
+type sidecarMatcher struct {
+	mode    string
+	names   stringSet
+	globs   []string
+	regexps []*regexp.Regexp
+}
+
+// newSidecarMatcher compiles the patterns for the match mode, returning an
+// error for an unknown mode or an invalid pattern
+func newSidecarMatcher(mode string, patterns []string) (*sidecarMatcher, error) {
+	m := &sidecarMatcher{mode: mode, names: newStringSet()}
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		switch mode {
+		case SidecarMatchExact:
+			m.names.Add(pattern)
+		case SidecarMatchGlob:
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid sidecar glob %q: %w", pattern, err)
+			}
+			m.globs = append(m.globs, pattern)
+		case SidecarMatchRegex:
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid sidecar regex %q: %w", pattern, err)
+			}
+			m.regexps = append(m.regexps, re)
+		default:
+			return nil, fmt.Errorf("unknown sidecar match mode %q", mode)
+		}
+	}
+	return m, nil
+}
+
+// Empty reports whether the matcher has no patterns and so matches nothing
+func (m *sidecarMatcher) Empty() bool {
+	return m.names.Len() == 0 && len(m.globs) == 0 && len(m.regexps) == 0
+}
+
+// Match reports whether the container name is a sidecar
+func (m *sidecarMatcher) Match(name string) bool {
+	if m.names.Contains(name) {
+		return true
+	}
+	for _, glob := range m.globs {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSidecarMatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		patterns []string
+		match    []string
+		noMatch  []string
+	}{
+		{
+			name:     "exact",
+			mode:     SidecarMatchExact,
+			patterns: []string{"istio-proxy", " vault-agent "},
+			match:    []string{"istio-proxy", "vault-agent"},
+			noMatch:  []string{"istio-proxy-abc123", "istio"},
+		},
+		{
+			name:     "glob",
+			mode:     SidecarMatchGlob,
+			patterns: []string{"istio-proxy-*", "vault-agent-?"},
+			match:    []string{"istio-proxy-abc123", "vault-agent-1"},
+			noMatch:  []string{"istio-proxy", "vault-agent-12", "app"},
+		},
+		{
+			name:     "regex",
+			mode:     SidecarMatchRegex,
+			patterns: []string{"istio-proxy(-[a-z0-9]+)?", "vault-agent-[0-9]+"},
+			match:    []string{"istio-proxy", "istio-proxy-abc123", "vault-agent-12"},
+			// Regexes match the whole name
+			noMatch: []string{"my-istio-proxy", "vault-agent-", "app"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newSidecarMatcher(tt.mode, tt.patterns)
+			if err != nil {
+				t.Fatalf("newSidecarMatcher() error = %v", err)
+			}
+			for _, name := range tt.match {
+				if !m.Match(name) {
+					t.Errorf("Match(%q) = false, want true", name)
+				}
+			}
+			for _, name := range tt.noMatch {
+				if m.Match(name) {
+					t.Errorf("Match(%q) = true, want false", name)
+				}
+			}
+		})
+	}
+}
+
+func TestSidecarMatcherInvalid(t *testing.T) {
+	tests := []struct {
+		mode     string
+		patterns []string
+	}{
+		{mode: SidecarMatchGlob, patterns: []string{"istio-proxy-["}},
+		{mode: SidecarMatchRegex, patterns: []string{"istio-proxy-(.*"}},
+		{mode: "fuzzy", patterns: []string{"istio-proxy"}},
+	}
+	for _, tt := range tests {
+		if _, err := newSidecarMatcher(tt.mode, tt.patterns); err == nil {
+			t.Errorf("newSidecarMatcher(%q, %q) succeeded, want an error", tt.mode, tt.patterns)
+		}
+	}
+}
+
+func TestSidecarMatcherEmpty(t *testing.T) {
+	m, err := newSidecarMatcher(SidecarMatchExact, []string{"", " "})
+	if err != nil {
+		t.Fatalf("newSidecarMatcher() error = %v", err)
+	}
+	if !m.Empty() {
+		t.Error("Empty() = false for blank patterns, want true")
+	}
+}
+
+func TestSyncHandlerGlobSidecar(t *testing.T) {
+	pod := newJobPod("glob", terminated("app", "Completed", 0), running("istio-proxy-abc123"))
+	opts := newTestOptions()
+	opts.SidecarMatchMode = SidecarMatchGlob
+	opts.Sidecars = []string{"istio-proxy-*"}
+	f := newFixture(t, opts, pod)
+
+	if err := f.sync(pod); err != nil {
+		t.Fatalf("syncHandler() error = %v", err)
+	}
+	if got, want := f.executor.containers(), []string{"istio-proxy-abc123"}; !equalStrings(got, want) {
+		t.Errorf("exec'd into %v, want %v", got, want)
+	}
+}
+
+func TestSidecarsForPodByImage(t *testing.T) {
+	pod := newJobPod("pod", terminated("app", "Completed", 0), running("proxy"), running("agent"))
+	pod.Spec.Containers[0].Image = "registry.example/batch/app:1.0"
+	pod.Spec.Containers[1].Image = "docker.io/istio/proxyv2:1.20.0"
+	pod.Spec.Containers[2].Image = "hashicorp/vault:1.15"
+	tests := []struct {
+		name     string
+		mode     string
+		patterns []string
+		want     []string
+	}{
+		{name: "regex", mode: SidecarMatchRegex, patterns: []string{".*istio/proxyv2.*"}, want: []string{"proxy"}},
+		{name: "glob", mode: SidecarMatchGlob, patterns: []string{"docker.io/istio/*", "hashicorp/vault:*"}, want: []string{"agent", "proxy"}},
+		{name: "exact", mode: SidecarMatchExact, patterns: []string{"hashicorp/vault:1.15"}, want: []string{"agent"}},
+		// Container names are not matched against
+		{name: "names", mode: SidecarMatchExact, patterns: []string{"proxy", "agent"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := newTestOptions()
+			opts.SidecarMatchMode = tt.mode
+			opts.SidecarMatchBy = SidecarMatchByImage
+			opts.Sidecars = tt.patterns
+			f := newFixture(t, opts, pod)
+			sidecars, err := f.controller.sidecarsForPod(pod)
+			if err != nil {
+				t.Fatalf("sidecarsForPod() error = %v", err)
+			}
+			if got := sidecars.ToSlice(); !equalStrings(got, tt.want) {
+				t.Errorf("sidecars = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
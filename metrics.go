@@ -0,0 +1,208 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/util/workqueue"
+)
+
+var (
+	// shutdownAttempts counts the shutdown commands sent to sidecar
+	// containers, partitioned by container name and result
+	shutdownAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sidecar_shutdown_attempts_total",
+			Help: "Number of shutdown commands sent to sidecar containers.",
+		},
+		[]string{"container", "result"},
+	)
+
+	// podsProcessed counts the pods evaluated by syncHandler
+	podsProcessed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pods_processed_total",
+			Help: "Number of pods processed by the controller.",
+		},
+	)
+
+	// podsSkipped counts the pods the controller did not act on,
+	// partitioned by the reason they were skipped for
+	podsSkipped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pods_skipped_total",
+			Help: "Number of times pods were skipped, by reason.",
+		},
+		[]string{"reason"},
+	)
+
+	// sidecarNameMismatch counts the pods whose only running container is
+	// not a sidecar while all the others completed, which usually means
+	// the sidecar names are misconfigured
+	sidecarNameMismatch = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sidecar_name_mismatch_total",
+			Help: "Number of pods whose only running container is not one of the sidecars.",
+		},
+	)
+
+	// processVerifications counts the runs of the verify command in
+	// signaled sidecars, partitioned by container name and whether their
+	// process exited
+	processVerifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sidecar_process_verifications_total",
+			Help: "Number of signaled sidecars whose process was verified to have exited or not.",
+		},
+		[]string{"container", "result"},
+	)
+
+	// execDuration observes how long the exec stream into a sidecar takes
+	execDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "sidecar_exec_duration_seconds",
+			Help:    "Duration of the exec streams used to shut down sidecar containers.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"container"},
+	)
+
+	// sidecarCandidates is the number of pods whose main containers have
+	// finished while their sidecars keep running, tracked in report-only
+	// mode
+	sidecarCandidates = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sidecar_candidates",
+			Help: "Number of pods whose sidecars would be shut down, tracked with --report-only.",
+		},
+	)
+
+	// shutdownLatency observes the time between the last main container of
+	// a pod finishing and its sidecars being sent the shutdown command
+	shutdownLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "sidecar_shutdown_latency_seconds",
+			Help:    "Time from the main containers finishing to the sidecars being shut down.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+		},
+	)
+)
+
+// The workqueue metrics, partitioned by the name of the queue
+var (
+	workqueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workqueue_depth",
+			Help: "Current depth of the workqueue.",
+		},
+		[]string{"name"},
+	)
+	workqueueAdds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workqueue_adds_total",
+			Help: "Total number of adds handled by the workqueue.",
+		},
+		[]string{"name"},
+	)
+	workqueueLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "workqueue_queue_duration_seconds",
+			Help:    "How long an item stays in the workqueue before being requested.",
+			Buckets: prometheus.ExponentialBuckets(10e-9, 10, 10),
+		},
+		[]string{"name"},
+	)
+	workqueueWorkDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "workqueue_work_duration_seconds",
+			Help:    "How long processing an item from the workqueue takes.",
+			Buckets: prometheus.ExponentialBuckets(10e-9, 10, 10),
+		},
+		[]string{"name"},
+	)
+	workqueueUnfinishedWork = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workqueue_unfinished_work_seconds",
+			Help: "How many seconds of work has been done that is in progress and hasn't been observed by work_duration.",
+		},
+		[]string{"name"},
+	)
+	workqueueLongestRunningProcessor = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workqueue_longest_running_processor_seconds",
+			Help: "How many seconds the longest running processor for the workqueue has been running.",
+		},
+		[]string{"name"},
+	)
+	workqueueRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workqueue_retries_total",
+			Help: "Total number of retries handled by the workqueue.",
+		},
+		[]string{"name"},
+	)
+)
+
+// workqueueMetricsProvider implements workqueue.MetricsProvider with the
+// prometheus workqueue metrics
+type workqueueMetricsProvider struct{}
+
+func (workqueueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return workqueueDepth.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return workqueueAdds.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return workqueueLatency.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return workqueueWorkDuration.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueUnfinishedWork.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueLongestRunningProcessor.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return workqueueRetries.WithLabelValues(name)
+}
+
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+// Results of processVerifications
+const (
+	verifyExited  = "exited"
+	verifyRunning = "running"
+	verifyError   = "error"
+)
+
+// Reasons of podsSkipped
+const (
+	skipNotOwned          = "not_owned"
+	skipNamespaceExcluded = "namespace_excluded"
+	skipNotFound          = "not_found"
+	skipDeleting          = "deleting"
+	skipNotRunning        = "not_running"
+	skipOptOut            = "opt_out"
+	skipAlreadySignaled   = "already_signaled"
+	skipAbandoned         = "abandoned"
+	skipNoSidecars        = "no_sidecars"
+	skipKeepSidecars      = "keep_sidecars"
+	skipNotEligible       = "not_eligible"
+)
+
+func init() {
+	prometheus.MustRegister(shutdownAttempts, podsProcessed, execDuration, shutdownLatency, sidecarCandidates,
+		sidecarNameMismatch, podsSkipped, processVerifications)
+	prometheus.MustRegister(workqueueDepth, workqueueAdds, workqueueLatency, workqueueWorkDuration,
+		workqueueUnfinishedWork, workqueueLongestRunningProcessor, workqueueRetries)
+}
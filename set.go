@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// stringSet is a set of strings
+type stringSet map[string]struct{}
+
+// newStringSet returns a set holding the items
+func newStringSet(items ...string) stringSet {
+	s := make(stringSet, len(items))
+	for _, item := range items {
+		s.Add(item)
+	}
+	return s
+}
+
+// Add adds the item to the set
+func (s stringSet) Add(item string) {
+	s[item] = struct{}{}
+}
+
+// Contains reports whether the item is in the set
+func (s stringSet) Contains(item string) bool {
+	_, ok := s[item]
+	return ok
+}
+
+// Len returns the number of items in the set
+func (s stringSet) Len() int {
+	return len(s)
+}
+
+// Union returns a new set with the items of both sets
+func (s stringSet) Union(other stringSet) stringSet {
+	union := make(stringSet, len(s)+len(other))
+	for item := range s {
+		union.Add(item)
+	}
+	for item := range other {
+		union.Add(item)
+	}
+	return union
+}
+
+// Difference returns a new set with the items of s that are not in other
+func (s stringSet) Difference(other stringSet) stringSet {
+	difference := make(stringSet)
+	for item := range s {
+		if !other.Contains(item) {
+			difference.Add(item)
+		}
+	}
+	return difference
+}
+
+// Intersection returns a new set with the items in both sets
+func (s stringSet) Intersection(other stringSet) stringSet {
+	intersection := make(stringSet)
+	for item := range s {
+		if other.Contains(item) {
+			intersection.Add(item)
+		}
+	}
+	return intersection
+}
+
+// IsSubset reports whether every item of s is in other
+func (s stringSet) IsSubset(other stringSet) bool {
+	for item := range s {
+		if !other.Contains(item) {
+			return false
+		}
+	}
+	return true
+}
+
+// Equal reports whether both sets hold the same items
+func (s stringSet) Equal(other stringSet) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for item := range s {
+		if !other.Contains(item) {
+			return false
+		}
+	}
+	return true
+}
+
+// ToSlice returns the items of the set in sorted order
+func (s stringSet) ToSlice() []string {
+	items := make([]string, 0, len(s))
+	for item := range s {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+	return items
+}
+
+// String formats the set as {a, b}
+func (s stringSet) String() string {
+	return "{" + strings.Join(s.ToSlice(), ", ") + "}"
+}
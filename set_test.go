@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStringSetOperations(t *testing.T) {
+	a := newStringSet("app", "istio-proxy", "vault-agent")
+	b := newStringSet("istio-proxy", "vault-agent", "log-shipper")
+
+	tests := []struct {
+		name string
+		got  stringSet
+		want []string
+	}{
+		{name: "union", got: a.Union(b), want: []string{"app", "istio-proxy", "log-shipper", "vault-agent"}},
+		{name: "difference", got: a.Difference(b), want: []string{"app"}},
+		{name: "intersection", got: a.Intersection(b), want: []string{"istio-proxy", "vault-agent"}},
+		{name: "union with empty", got: a.Union(newStringSet()), want: []string{"app", "istio-proxy", "vault-agent"}},
+		{name: "difference with itself", got: a.Difference(a), want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.got.ToSlice(); !equalStrings(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// The operations return new sets and leave their operands alone
+	if got := a.ToSlice(); !equalStrings(got, []string{"app", "istio-proxy", "vault-agent"}) {
+		t.Errorf("operand modified to %v", got)
+	}
+}
+
+func TestStringSetComparisons(t *testing.T) {
+	sidecars := newStringSet("istio-proxy", "vault-agent")
+	tests := []struct {
+		name       string
+		s          stringSet
+		wantSubset bool
+		wantEqual  bool
+	}{
+		{name: "empty", s: newStringSet(), wantSubset: true},
+		{name: "strict subset", s: newStringSet("istio-proxy"), wantSubset: true},
+		{name: "same items", s: newStringSet("vault-agent", "istio-proxy"), wantSubset: true, wantEqual: true},
+		{name: "overlapping", s: newStringSet("istio-proxy", "app")},
+		{name: "disjoint", s: newStringSet("app", "log-shipper")},
+		{name: "superset", s: newStringSet("istio-proxy", "vault-agent", "app")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.s.IsSubset(sidecars); got != tt.wantSubset {
+				t.Errorf("IsSubset() = %v, want %v", got, tt.wantSubset)
+			}
+			if got := tt.s.Equal(sidecars); got != tt.wantEqual {
+				t.Errorf("Equal() = %v, want %v", got, tt.wantEqual)
+			}
+			if got := sidecars.Equal(tt.s); got != tt.wantEqual {
+				t.Errorf("Equal() reversed = %v, want %v", got, tt.wantEqual)
+			}
+		})
+	}
+}
+
+func TestStringSetString(t *testing.T) {
+	tests := []struct {
+		s    stringSet
+		want string
+	}{
+		{s: newStringSet(), want: "{}"},
+		{s: newStringSet("istio-proxy"), want: "{istio-proxy}"},
+		// Sorted so that Events and logs are stable
+		{s: newStringSet("vault-agent", "istio-proxy", "app", "istio-proxy"), want: "{app, istio-proxy, vault-agent}"},
+	}
+	for _, tt := range tests {
+		if got := tt.s.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestNewSetFromSlice(t *testing.T) {
+	got := newSetFromSlice([]string{" istio-proxy", "", "vault-agent ", " "})
+	if want := []string{"istio-proxy", "vault-agent"}; !equalStrings(got.ToSlice(), want) {
+		t.Errorf("newSetFromSlice() = %v, want %v", got, want)
+	}
+}
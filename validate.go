@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// permission is an API access the controller needs, checked by --validate
+type permission struct {
+	verb        string
+	group       string
+	resource    string
+	subresource string
+	namespace   string
+}
+
+func (p permission) String() string {
+	resource := p.resource
+	if p.subresource != "" {
+		resource += "/" + p.subresource
+	}
+	if p.group != "" {
+		resource += "." + p.group
+	}
+	if p.namespace != "" {
+		return fmt.Sprintf("%s %s in namespace %s", p.verb, resource, p.namespace)
+	}
+	return fmt.Sprintf("%s %s in all namespaces", p.verb, resource)
+}
+
+// requiredPermissions returns the permissions the controller needs to run
+// with the flags it was started with. An empty namespace stands for all
+// namespaces.
+func requiredPermissions(configMapNamespace string) ([]permission, error) {
+	var perms []permission
+	for _, verb := range []string{"get", "list", "watch", "patch"} {
+		perms = append(perms, permission{verb: verb, resource: "pods", namespace: namespace})
+	}
+	if deleteOnGiveUp {
+		perms = append(perms, permission{verb: "delete", resource: "pods", namespace: namespace})
+	}
+	perms = append(perms,
+		permission{verb: "create", resource: "pods", subresource: "exec", namespace: namespace},
+		permission{verb: "create", resource: "events", namespace: namespace},
+		permission{verb: "patch", resource: "events", namespace: namespace},
+	)
+	if ephemeralFallback {
+		perms = append(perms, permission{verb: "update", resource: "pods", subresource: "ephemeralcontainers", namespace: namespace})
+	}
+	if configMapNamespace != "" {
+		for _, verb := range []string{"get", "list", "watch"} {
+			perms = append(perms, permission{verb: verb, resource: "configmaps", namespace: configMapNamespace})
+		}
+	}
+	if watchJobs {
+		for _, verb := range []string{"get", "list", "watch"} {
+			perms = append(perms, permission{verb: verb, group: "batch", resource: "jobs", namespace: namespace})
+		}
+	}
+	if enableLeaderElection {
+		// The Lease is taken in the namespace the controller runs in by
+		// default, not in all namespaces
+		leaseNS, err := leaseNamespace(leaderElectionNamespace)
+		if err != nil {
+			return nil, err
+		}
+		for _, verb := range []string{"get", "create", "update"} {
+			perms = append(perms, permission{verb: verb, group: "coordination.k8s.io", resource: "leases",
+				namespace: leaseNS})
+		}
+	}
+	return perms, nil
+}
+
+// validateAccess checks that the API server is reachable and returns the
+// permissions from perms the controller's credentials lack
+func validateAccess(ctx context.Context, kubeClient kubernetes.Interface, perms []permission) ([]permission, error) {
+	if _, err := kubeClient.Discovery().ServerVersion(); err != nil {
+		return nil, fmt.Errorf("error reaching the API server: %w", err)
+	}
+
+	var missing []permission
+	for _, p := range perms {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   p.namespace,
+					Verb:        p.verb,
+					Group:       p.group,
+					Resource:    p.resource,
+					Subresource: p.subresource,
+				},
+			},
+		}
+		result, err := kubeClient.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error reviewing access to %s: %w", p, err)
+		}
+		if !result.Status.Allowed {
+			missing = append(missing, p)
+		}
+	}
+	return missing, nil
+}
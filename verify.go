@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	utilexec "k8s.io/client-go/util/exec"
+	"k8s.io/klog/v2"
+)
+
+// verifyProcesses runs the verify command in the sidecars that were sent the
+// shutdown command, to tell a signal that was sent from a process that
+// exited. The sidecars are verified concurrently, so that the whole
+// verification takes at most verifyCommandTimeout. It records the outcome for
+// every sidecar in the processVerifications metric and the Events of the pod.
+func (c *Controller) verifyProcesses(ctx context.Context, pod *corev1.Pod, results shutdownResults) {
+	if c.verifyCommand == "" || c.dryRun {
+		return
+	}
+	logger := klog.FromContext(ctx)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	exited, running := newStringSet(), newStringSet()
+	for _, result := range results {
+		if result.err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(container string) {
+			defer wg.Done()
+			ok, err := c.verifyProcess(ctx, pod, container)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				logger.Error(err, "Error verifying that the sidecar process exited", "pod", klog.KObj(pod),
+					"container", container)
+				processVerifications.WithLabelValues(container, verifyError).Inc()
+			case ok:
+				exited.Add(container)
+				processVerifications.WithLabelValues(container, verifyExited).Inc()
+			default:
+				running.Add(container)
+				processVerifications.WithLabelValues(container, verifyRunning).Inc()
+			}
+		}(result.container)
+	}
+	wg.Wait()
+	if exited.Len() > 0 {
+		c.recorder.Eventf(pod, corev1.EventTypeNormal, SidecarProcessExited, MessageSidecarProcessExited, exited)
+	}
+	if running.Len() > 0 {
+		logger.Info("Sidecar processes still running after the shutdown command", "pod", klog.KObj(pod),
+			"containers", running)
+		c.recorder.Eventf(pod, corev1.EventTypeWarning, SidecarProcessRunning, MessageSidecarProcessRunning,
+			running, verifyCommandTimeout)
+	}
+}
+
+// verifyProcess runs the verify command in the sidecar until it reports the
+// process exited, by exiting with a non-zero status like pgrep does, or
+// verifyCommandTimeout elapsed. A sidecar whose container stopped or is gone
+// has exited as well. Failed execs are retried until the timeout, which
+// reports the error of the last one.
+func (c *Controller) verifyProcess(ctx context.Context, pod *corev1.Pod, container string) (bool, error) {
+	cmd := []string{c.execShell, "-c", c.verifyCommand}
+	if c.execShell == ExecShellNone {
+		cmd = strings.Fields(c.verifyCommand)
+	}
+	var lastErr error
+	err := wait.PollUntilContextTimeout(ctx, verifyCommandInterval, verifyCommandTimeout, true,
+		func(ctx context.Context) (bool, error) {
+			exited, err := c.execVerify(ctx, pod, container, cmd)
+			if err != nil {
+				klog.FromContext(ctx).V(4).Info("Verify command failed, retrying", "pod", klog.KObj(pod),
+					"container", container, "err", err)
+			}
+			lastErr = err
+			return exited, nil
+		})
+	if err == nil {
+		return true, nil
+	}
+	if wait.Interrupted(err) && ctx.Err() == nil {
+		return false, lastErr
+	}
+	return false, err
+}
+
+// execVerify runs the verify command in the sidecar once and reports whether
+// the process exited
+func (c *Controller) execVerify(ctx context.Context, pod *corev1.Pod, container string, cmd []string) (bool, error) {
+	select {
+	case c.execSlots <- struct{}{}:
+	case <-ctx.Done():
+		return false, fmt.Errorf("waiting for an exec slot: %w", ctx.Err())
+	}
+	defer func() { <-c.execSlots }()
+
+	execCtx, cancel := context.WithTimeout(ctx, c.execTimeout)
+	defer cancel()
+	_, stderr, err := c.executor.Exec(execCtx, pod.Namespace, pod.Name, container, cmd, nil)
+	if err == nil {
+		return false, nil
+	}
+	if containerNotFound(err) {
+		return true, nil
+	}
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) && !commandNotFound(err) {
+		return true, nil
+	}
+	// Execs into a stopped container fail, which is the outcome being
+	// waited for
+	if current, getErr := c.podsLister.Pods(pod.Namespace).Get(pod.Name); getErr == nil && containerTerminated(current, container) {
+		return true, nil
+	}
+	if stderr = truncateOutput(stderr); stderr != "" {
+		return false, fmt.Errorf("%w: %s", err, stderr)
+	}
+	return false, err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// sequenceExecutor fails the execs into a container with its errors in turn,
+// repeating the last one
+type sequenceExecutor struct {
+	mu   sync.Mutex
+	errs map[string][]error
+}
+
+// Exec implements Executor
+func (e *sequenceExecutor) Exec(ctx context.Context, namespace, pod, container string, cmd []string, stdin io.Reader) (string, string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	errs := e.errs[container]
+	if len(errs) == 0 {
+		return "", "", nil
+	}
+	err := errs[0]
+	if len(errs) > 1 {
+		e.errs[container] = errs[1:]
+	}
+	return "", "", err
+}
+
+func TestVerifyProcesses(t *testing.T) {
+	exited := utilexec.CodeExitError{Err: errors.New("command terminated with exit code 1"), Code: 1}
+	pod := newJobPod("done", terminated("app", "Completed", 0), running("istio-proxy"), running("vault-agent"))
+	opts := newTestOptions()
+	opts.Sidecars = []string{"istio-proxy", "vault-agent"}
+	opts.VerifyCommand = "pgrep envoy"
+	f := newFixture(t, opts, pod)
+	f.controller.executor = &sequenceExecutor{errs: map[string][]error{
+		// A transient failure is retried instead of deciding the outcome
+		"istio-proxy": {errors.New("connection reset by peer"), exited},
+		"vault-agent": {exited},
+	}}
+
+	f.controller.verifyProcesses(f.ctx, pod, shutdownResults{{container: "istio-proxy"}, {container: "vault-agent"}})
+	events := f.events()
+	if len(events) != 1 || !strings.HasPrefix(events[0], "Normal "+SidecarProcessExited) ||
+		!strings.Contains(events[0], "istio-proxy") || !strings.Contains(events[0], "vault-agent") {
+		t.Errorf("events = %v, want a single %s Event for both sidecars", events, SidecarProcessExited)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// preShutdownRequest is the JSON payload posted to the pre-shutdown webhook
+type preShutdownRequest struct {
+	Namespace  string   `json:"namespace"`
+	Name       string   `json:"name"`
+	UID        string   `json:"uid"`
+	Containers []string `json:"containers"`
+}
+
+// shutdownVetoedError is returned when the pre-shutdown webhook answered
+// anything but 200. Unlike a failed shutdown it is not retried with backoff
+// and never makes the controller give up on the pod, the webhook decides when
+// the sidecars may be shut down.
+type shutdownVetoedError struct {
+	status string
+}
+
+func (e *shutdownVetoedError) Error() string {
+	return fmt.Sprintf("pre-shutdown webhook answered %s", e.status)
+}
+
+// callPreShutdownWebhook posts the pod and the sidecars about to be shut down
+// to the pre-shutdown webhook. The shutdown may only proceed when it returns
+// nil, that is when the webhook answered 200. Other answers return a
+// *shutdownVetoedError, recorded as an Event once per pod.
+func (c *Controller) callPreShutdownWebhook(ctx context.Context, pod *corev1.Pod, containers stringSet) error {
+	body, err := json.Marshal(preShutdownRequest{
+		Namespace:  pod.Namespace,
+		Name:       pod.Name,
+		UID:        string(pod.UID),
+		Containers: containers.ToSlice(),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.preShutdownWebhook, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error building pre-shutdown webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.webhookClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling pre-shutdown webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	// Drain a bounded part of the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode != http.StatusOK {
+		klog.FromContext(ctx).Info("Pre-shutdown webhook did not allow the shutdown", "pod", klog.KObj(pod),
+			"status", resp.StatusCode)
+		if _, ok := c.vetoed.Get(pod.UID); !ok {
+			c.vetoed.Add(pod.UID, struct{}{}, signaledCacheTTL)
+			c.recorder.Eventf(pod, corev1.EventTypeWarning, ShutdownVetoed, MessageShutdownVetoed, resp.StatusCode)
+		}
+		return &shutdownVetoedError{status: resp.Status}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPreShutdownWebhookVeto(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusConflict)
+	var requests []preShutdownRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req preShutdownRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("error decoding the webhook request: %v", err)
+		}
+		requests = append(requests, req)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	pod := newJobPod("done", terminated("app", "Completed", 0), running("istio-proxy"))
+	opts := newTestOptions()
+	opts.PreShutdownWebhook = server.URL
+	opts.PreShutdownWebhookTimeout = time.Second
+	opts.MaxRetries = 1
+	opts.DeletePodOnGiveUp = true
+	f := newFixture(t, opts, pod)
+
+	// Vetoes are neither retried with backoff nor given up on
+	for i := 0; i < 3; i++ {
+		f.process(pod)
+		if got := f.controller.workqueue.NumRequeues(podKey(pod)); got != 0 {
+			t.Fatalf("NumRequeues() = %d after %d vetoes, want 0", got, i+1)
+		}
+	}
+	if got := f.executor.containers(); len(got) != 0 {
+		t.Errorf("exec'd into %v despite the veto", got)
+	}
+	events := f.events()
+	if len(events) != 1 || !strings.HasPrefix(events[0], "Warning "+ShutdownVetoed) {
+		t.Errorf("events = %v, want a single %s Event", events, ShutdownVetoed)
+	}
+	for _, action := range f.client.Actions() {
+		if action.GetVerb() == "delete" {
+			t.Errorf("vetoed pod deleted: %v", action)
+		}
+	}
+	if len(requests) != 3 || requests[0].Name != pod.Name || !equalStrings(requests[0].Containers, []string{"istio-proxy"}) {
+		t.Errorf("webhook requests = %+v, want 3 requests for the istio-proxy of %s", requests, pod.Name)
+	}
+
+	status.Store(http.StatusOK)
+	if err := f.sync(pod); err != nil {
+		t.Fatalf("syncHandler() error = %v", err)
+	}
+	if got, want := f.executor.containers(), []string{"istio-proxy"}; !equalStrings(got, want) {
+		t.Errorf("exec'd into %v once allowed, want %v", got, want)
+	}
+}